@@ -0,0 +1,97 @@
+// Package apple packages the requirements of Apple's Web Push service, used
+// by Safari and iOS Home Screen web apps, on top of the webpush package.
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/daaku/webpush"
+)
+
+// Apple does not accept records larger than this.
+const maxRecordSize = 4096
+
+// ErrUnregistered matches an Error where the Subscription is no longer valid.
+var ErrUnregistered = errors.New("apple: subscription unregistered")
+
+// ErrPayloadTooLarge matches an Error where the message was too large.
+var ErrPayloadTooLarge = errors.New("apple: payload too large")
+
+// ErrBadJWT matches an Error where the VAPID token was rejected, for example
+// because it was malformed, expired or had an invalid Subscriber.
+var ErrBadJWT = errors.New("apple: vapid token rejected")
+
+// Error is a webpush.Error with the reason Apple provided.
+type Error struct {
+	Err    *webpush.Error
+	Reason string // For example "Unregistered" or "BadJwtToken".
+}
+
+// Error returns the error message.
+func (e *Error) Error() string {
+	return fmt.Sprintf("apple: %s: %s", e.Err.EndpointHost, e.Reason)
+}
+
+// Unwrap returns the underlying webpush.Error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is supports matching the error classes defined by this package using
+// errors.Is.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnregistered:
+		return e.Reason == "Unregistered"
+	case ErrPayloadTooLarge:
+		return e.Reason == "PayloadTooLarge"
+	case ErrBadJWT:
+		return strings.HasSuffix(e.Reason, "JwtToken") || strings.HasSuffix(e.Reason, "ProviderToken")
+	}
+	return false
+}
+
+// Configure returns a copy of the Client configured for Apple. Apple requires
+// a Subscriber, so an error is returned if one is not set, and it rejects
+// records larger than 4096 bytes, so RecordSize is clamped.
+func Configure(c *webpush.Client) (*webpush.Client, error) {
+	subscriber := c.Resolve().Subscriber
+	if subscriber == "" {
+		return nil, errors.New("apple: a https or mailto: subscriber is required")
+	}
+	if !strings.HasPrefix(subscriber, "https:") && !strings.HasPrefix(subscriber, "mailto:") {
+		return nil, fmt.Errorf("apple: invalid subscriber %q, must be https or mailto:", subscriber)
+	}
+	configured := *c
+	configured.RecordSize = min(c.Resolve().RecordSize, maxRecordSize)
+	return &configured, nil
+}
+
+// Send sends the Push Notification to an Apple Subscription, returning an
+// Error if Apple responded with a reason.
+func Send(ctx context.Context, c *webpush.Client, message []byte, s *webpush.Subscription, opts ...webpush.SendOption) error {
+	if service := webpush.DetectPushService(s.Endpoint); service != webpush.PushServiceApple {
+		return fmt.Errorf("apple: endpoint is not an apple push service: %q", s.Endpoint)
+	}
+	return Wrap(c.Send(ctx, message, s, opts...))
+}
+
+// Wrap returns an Error for a webpush.Error with an Apple reason in the body,
+// and returns all other errors as is.
+func Wrap(err error) error {
+	pushErr, ok := errors.AsType[*webpush.Error](err)
+	if !ok {
+		return err
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(pushErr.Body, &body) != nil || body.Reason == "" {
+		return err
+	}
+	return &Error{Err: pushErr, Reason: body.Reason}
+}
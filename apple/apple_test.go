@@ -0,0 +1,86 @@
+package apple
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+	"github.com/daaku/webpush"
+	"github.com/daaku/webpush/webpushtest"
+)
+
+const endpoint = "https://web.push.apple.com/capability-url"
+
+func newClient(t *testing.T, rec *webpushtest.Recorder) *webpush.Client {
+	vapidKey, err := webpush.ParseVAPIDKey("Npnu7ulDI0A5nvDXgrEreznX809sYVuIqEh7AXG2oOk")
+	ensure.Nil(t, err)
+	return &webpush.Client{
+		Client:     rec.Client(),
+		VAPIDKey:   vapidKey,
+		Subscriber: "mailto:admin@app.server",
+		TTL:        time.Hour,
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	rec, err := webpushtest.NewRecorder()
+	ensure.Nil(t, err)
+	client := newClient(t, rec)
+	client.RecordSize = 8192
+	configured, err := Configure(client)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, configured.RecordSize, maxRecordSize)
+	ensure.DeepEqual(t, client.RecordSize, 8192)
+	ensure.DeepEqual(t, configured.MaxPayload(rec.Subscription(endpoint)), maxRecordSize-webpush.MinOverhead)
+
+	client.Subscriber = ""
+	_, err = Configure(client)
+	ensure.Err(t, err, regexp.MustCompile("subscriber is required"))
+	client.Subscriber = "admin@app.server"
+	_, err = Configure(client)
+	ensure.Err(t, err, regexp.MustCompile("invalid subscriber"))
+}
+
+func TestSendReason(t *testing.T) {
+	rec, err := webpushtest.NewRecorder()
+	ensure.Nil(t, err)
+	rec.Respond = func(*http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusGone,
+			Body:       io.NopCloser(strings.NewReader(`{"reason":"Unregistered"}`)),
+		}
+	}
+	client, err := Configure(newClient(t, rec))
+	ensure.Nil(t, err)
+	err = Send(context.Background(), client, []byte("test"), rec.Subscription(endpoint))
+	ensure.True(t, errors.Is(err, ErrUnregistered), err)
+	ensure.False(t, errors.Is(err, ErrBadJWT))
+	pushErr, ok := errors.AsType[*webpush.Error](err)
+	ensure.True(t, ok, err)
+	ensure.True(t, pushErr.Permanent)
+	ensure.DeepEqual(t, string(rec.Requests()[0].Payload), "test")
+
+	rec.Respond = func(*http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusForbidden,
+			Body:       io.NopCloser(strings.NewReader(`{"reason":"BadJwtToken"}`)),
+		}
+	}
+	err = Send(context.Background(), client, []byte("test"), rec.Subscription(endpoint))
+	ensure.True(t, errors.Is(err, ErrBadJWT), err)
+	ensure.True(t, errors.Is(err, webpush.ErrVAPIDRejected), err)
+}
+
+func TestSendNotApple(t *testing.T) {
+	rec, err := webpushtest.NewRecorder()
+	ensure.Nil(t, err)
+	err = Send(context.Background(), newClient(t, rec), []byte("test"), rec.Subscription("https://fcm.googleapis.com/x"))
+	ensure.Err(t, err, regexp.MustCompile("not an apple push service"))
+	ensure.DeepEqual(t, len(rec.Requests()), 0)
+}
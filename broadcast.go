@@ -0,0 +1,387 @@
+package webpush
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultConcurrency = 16
+	maxReportSamples   = 5
+	verifyTopic        = "webpush-verify"
+)
+
+// ErrMaxOrigins is returned when the Subscriptions span more origins than the
+// Broadcaster MaxOrigins.
+var ErrMaxOrigins = errors.New("webpush: broadcast exceeded max origins")
+
+// ErrMaxBytes is the result for the Subscription whose send would have
+// exceeded the Broadcaster MaxBytes.
+var ErrMaxBytes = errors.New("webpush: broadcast exceeded max bytes")
+
+// BroadcastResult is the outcome of sending to a single Subscription.
+type BroadcastResult struct {
+	Subscription *Subscription
+	Err          error // The error returned by Send, if any.
+}
+
+// Broadcaster sends a single message to many Subscriptions concurrently.
+type Broadcaster struct {
+	Client      *Client // Required Client used for each Send.
+	Concurrency int     // Optional limit on concurrent sends, defaults to 16.
+
+	// MaxBytes optionally limits the total size of the encrypted records sent.
+	// Once a send would exceed it, that send fails with ErrMaxBytes and no new
+	// sends are dispatched.
+	MaxBytes int64
+
+	// MaxInFlightBytes optionally limits the total size of the encrypted
+	// records of the sends in flight, bounding memory use for large records
+	// independently of Concurrency. A send waits for enough of the limit to be
+	// available before its message is encrypted, using the message length plus
+	// MinOverhead and any Compress flag byte as the record size, so growth from
+	// an Envelope is not accounted for. A record larger than the limit is sent once nothing else
+	// is in flight.
+	MaxInFlightBytes int64
+
+	// MaxOrigins optionally limits the number of distinct Endpoint origins a
+	// broadcast may contact, as a guard against untrusted Subscription lists.
+	// It is checked before any sends are dispatched.
+	MaxOrigins int
+
+	// DedupEndpoints collapses Subscriptions with the same Endpoint, ignoring
+	// the case of the scheme and host, keeping the first one. Duplicates have
+	// no result.
+	DedupEndpoints bool
+
+	// AdaptiveConcurrency optionally adjusts the limit on concurrent sends
+	// based on rate limiting by the Push Services, instead of using a fixed
+	// Concurrency.
+	AdaptiveConcurrency *AdaptiveConcurrency
+}
+
+// AdaptiveConcurrency starts a broadcast at Min concurrent sends, increasing
+// the limit by one after every limit successful sends, and halving it on
+// every send that fails with ErrRateLimited, staying within Min and Max.
+type AdaptiveConcurrency struct {
+	Min int // Optional lower bound, defaults to 1.
+	Max int // Optional upper bound, defaults to the Broadcaster Concurrency.
+
+	// OnChange is an optional callback invoked whenever the limit changes.
+	OnChange func(limit int)
+}
+
+// limiter bounds the number of concurrent sends, adjusting the limit between
+// min and max if adaptive.
+type limiter struct {
+	adaptive  *AdaptiveConcurrency
+	min, max  int
+	mu        sync.Mutex
+	limit     int
+	inFlight  int
+	successes int
+	wake      chan struct{}
+}
+
+func (b *Broadcaster) newLimiter() *limiter {
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	l := &limiter{min: concurrency, max: concurrency, wake: make(chan struct{})}
+	if a := b.AdaptiveConcurrency; a != nil {
+		l.adaptive = a
+		l.min, l.max = max(1, a.Min), a.Max
+		if l.max <= 0 {
+			l.max = concurrency
+		}
+		l.max = max(l.min, l.max)
+	}
+	l.limit = l.min
+	return l
+}
+
+// byteLimiter bounds the total bytes in flight.
+type byteLimiter struct {
+	max  int64
+	mu   sync.Mutex
+	used int64
+	wake chan struct{}
+}
+
+// acquire waits for n bytes to be available, or the context to be done.
+func (l *byteLimiter) acquire(ctx context.Context, n int64) error {
+	for {
+		l.mu.Lock()
+		if l.used == 0 || l.used+n <= l.max {
+			l.used += n
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// release returns n bytes.
+func (l *byteLimiter) release(n int64) {
+	l.mu.Lock()
+	l.used -= n
+	close(l.wake)
+	l.wake = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// acquire waits for a send to be allowed, or the context to be done.
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < l.limit {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// release completes a send, adjusting the limit based on the error.
+func (l *limiter) release(err error) {
+	l.mu.Lock()
+	l.inFlight--
+	limit := l.limit
+	if l.adaptive != nil {
+		if errors.Is(err, ErrRateLimited) {
+			l.limit = max(l.min, l.limit/2)
+			l.successes = 0
+		} else if err == nil {
+			l.successes++
+			if l.successes >= l.limit && l.limit < l.max {
+				l.limit++
+				l.successes = 0
+			}
+		}
+	}
+	changed := limit != l.limit
+	limit = l.limit
+	close(l.wake)
+	l.wake = make(chan struct{})
+	l.mu.Unlock()
+	if changed && l.adaptive.OnChange != nil {
+		l.adaptive.OnChange(limit)
+	}
+}
+
+// dedupEndpoints returns subs without duplicate Endpoints, along with the
+// number of duplicates removed.
+func dedupEndpoints(subs []*Subscription) ([]*Subscription, int) {
+	seen := make(map[string]bool, len(subs))
+	unique := make([]*Subscription, 0, len(subs))
+	for _, s := range subs {
+		key := endpointKey(s.Endpoint)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, s)
+	}
+	return unique, len(subs) - len(unique)
+}
+
+// endpointKey normalizes the case insensitive parts of the endpoint.
+func endpointKey(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// checkOrigins returns ErrMaxOrigins if subs span more than MaxOrigins.
+func (b *Broadcaster) checkOrigins(subs []*Subscription) error {
+	if b.MaxOrigins > 0 && len(GroupByOrigin(subs)) > b.MaxOrigins {
+		return ErrMaxOrigins
+	}
+	return nil
+}
+
+// Stream sends the message to each Subscription and yields results as they
+// complete. The channel is closed once all dispatched sends have completed,
+// and must be drained by the caller. Cancelling the context or exceeding
+// MaxBytes stops dispatching new sends, in which case the remaining
+// Subscriptions will have no result. If MaxOrigins is exceeded, nothing is
+// sent and every Subscription has ErrMaxOrigins as the result.
+func (b *Broadcaster) Stream(ctx context.Context, message []byte, subs []*Subscription) <-chan BroadcastResult {
+	if b.DedupEndpoints {
+		subs, _ = dedupEndpoints(subs)
+	}
+	return b.stream(ctx, message, subs)
+}
+
+func (b *Broadcaster) stream(ctx context.Context, message []byte, subs []*Subscription) <-chan BroadcastResult {
+	limiter := b.newLimiter()
+	results := make(chan BroadcastResult, limiter.max)
+	go func() {
+		defer close(results)
+		if err := b.checkOrigins(subs); err != nil {
+			for _, s := range subs {
+				results <- BroadcastResult{Subscription: s, Err: err}
+			}
+			return
+		}
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		var sent atomic.Int64
+		var exhausted atomic.Bool
+		var inFlight *byteLimiter
+		estimate := int64(len(message) + b.Client.overhead())
+		if b.MaxInFlightBytes > 0 {
+			inFlight = &byteLimiter{max: b.MaxInFlightBytes, wake: make(chan struct{})}
+		}
+		budget := func(req *http.Request) error {
+			if b.MaxBytes > 0 && sent.Add(req.ContentLength) > b.MaxBytes {
+				exhausted.Store(true)
+				return ErrMaxBytes
+			}
+			return nil
+		}
+		for _, s := range subs {
+			if ctx.Err() != nil || exhausted.Load() {
+				return
+			}
+			if limiter.acquire(ctx) != nil {
+				return
+			}
+			if exhausted.Load() {
+				return
+			}
+			wg.Go(func() {
+				var err error
+				if inFlight != nil {
+					err = inFlight.acquire(ctx, estimate)
+				}
+				if err == nil {
+					_, err = b.Client.send(ctx, message, &PreparedSubscription{Subscription: s}, budget)
+					if inFlight != nil {
+						inFlight.release(estimate)
+					}
+				}
+				results <- BroadcastResult{Subscription: s, Err: err}
+				limiter.release(err)
+			})
+		}
+	}()
+	return results
+}
+
+// BroadcastCount is the number of failures in a category, along with a
+// bounded sample of their error messages.
+type BroadcastCount struct {
+	Count   int
+	Samples []string // Up to 5 error messages.
+}
+
+func (c *BroadcastCount) add(err error) {
+	c.Count++
+	if len(c.Samples) < maxReportSamples {
+		c.Samples = append(c.Samples, err.Error())
+	}
+}
+
+// BroadcastReport summarizes the results of a broadcast.
+type BroadcastReport struct {
+	Sent        int            // Successful sends.
+	Gone        BroadcastCount // Permanent errors, the Subscriptions should be removed.
+	RateLimited BroadcastCount // Errors matching ErrRateLimited.
+	Failed      BroadcastCount // Other errors returned by the Endpoint.
+	Transport   BroadcastCount // Errors making the request, including ErrMaxBytes.
+	Duplicates  int            // Subscriptions skipped by DedupEndpoints.
+
+	// Undispatched is the number of Subscriptions that were not sent to
+	// because the context was cancelled or MaxBytes was exceeded, which means
+	// the broadcast was partial.
+	Undispatched int
+}
+
+// Send is Stream, with the results aggregated into a BroadcastReport. An
+// error is only returned if the broadcast could not be started, such as when
+// MaxOrigins is exceeded.
+func (b *Broadcaster) Send(ctx context.Context, message []byte, subs []*Subscription) (*BroadcastReport, error) {
+	if err := b.checkOrigins(subs); err != nil {
+		return nil, err
+	}
+	report := &BroadcastReport{}
+	if b.DedupEndpoints {
+		subs, report.Duplicates = dedupEndpoints(subs)
+	}
+	report.Undispatched = len(subs)
+	for r := range b.stream(ctx, message, subs) {
+		report.Undispatched--
+		pushErr, isPushErr := errors.AsType[*Error](r.Err)
+		switch {
+		case r.Err == nil:
+			report.Sent++
+		case !isPushErr:
+			report.Transport.add(r.Err)
+		case pushErr.Permanent:
+			report.Gone.add(r.Err)
+		case errors.Is(r.Err, ErrRateLimited):
+			report.RateLimited.add(r.Err)
+		default:
+			report.Failed.add(r.Err)
+		}
+	}
+	return report, nil
+}
+
+// VerifyResult is the outcome of verifying a single Subscription.
+type VerifyResult struct {
+	Subscription *Subscription
+	Live         bool  // The Push Service accepted the message.
+	Gone         bool  // The Push Service reported the Subscription is permanently gone.
+	Err          error // The error returned by Send, if any.
+}
+
+// VerifyLive sends an empty message with a zero TTL and a fixed Topic to each
+// Subscription, in order to prune Subscriptions that are gone without a
+// visible notification. Push Services deliver the message if the User Agent is
+// connected, so the Service Worker must ignore empty messages. Subscriptions
+// that were not dispatched because the context was cancelled have no result.
+func (b *Broadcaster) VerifyLive(ctx context.Context, subs []*Subscription) []VerifyResult {
+	verifier := &Broadcaster{
+		Client:              b.Client.withOptions([]SendOption{WithTTL(0), WithTopic(verifyTopic)}),
+		Concurrency:         b.Concurrency,
+		MaxOrigins:          b.MaxOrigins,
+		DedupEndpoints:      b.DedupEndpoints,
+		AdaptiveConcurrency: b.AdaptiveConcurrency,
+	}
+	var results []VerifyResult
+	for r := range verifier.Stream(ctx, nil, subs) {
+		pushErr, isPushErr := errors.AsType[*Error](r.Err)
+		results = append(results, VerifyResult{
+			Subscription: r.Subscription,
+			Live:         r.Err == nil,
+			Gone:         isPushErr && pushErr.Permanent,
+			Err:          r.Err,
+		})
+	}
+	return results
+}
@@ -0,0 +1,444 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func makeSubscriptions(n int) []*Subscription {
+	subs := make([]*Subscription, n)
+	for i := range subs {
+		sub := validSubscription
+		sub.Endpoint = fmt.Sprintf("%s/%d", validSubscription.Endpoint, i)
+		subs[i] = &sub
+	}
+	return subs
+}
+
+func TestBroadcastStream(t *testing.T) {
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+		Concurrency: 4,
+	}
+	subs := makeSubscriptions(20)
+	seen := make(map[*Subscription]bool)
+	for r := range b.Stream(context.Background(), []byte("test"), subs) {
+		ensure.Nil(t, r.Err)
+		ensure.False(t, seen[r.Subscription], "duplicate result")
+		seen[r.Subscription] = true
+	}
+	ensure.DeepEqual(t, len(seen), len(subs))
+}
+
+func TestBroadcastStreamCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{}, 10)
+	proceed := make(chan struct{})
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					started <- struct{}{}
+					<-proceed
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+		Concurrency: 1,
+	}
+	results := b.Stream(ctx, []byte("test"), makeSubscriptions(10))
+	// cancel while the first send is in flight, before it can complete
+	<-started
+	cancel()
+	close(proceed)
+	var count int
+	for range results {
+		count++
+	}
+	ensure.DeepEqual(t, count, 1)
+	ensure.DeepEqual(t, len(started), 0)
+}
+
+func TestBroadcastStreamMaxBytes(t *testing.T) {
+	message := []byte("test")
+	recordLen := int64(minOverhead + len(message))
+	var requests atomic.Int64
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					requests.Add(1)
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+		Concurrency: 1,
+		MaxBytes:    3*recordLen + 1,
+	}
+	var sent, cutoff int
+	for r := range b.Stream(context.Background(), message, makeSubscriptions(10)) {
+		switch {
+		case r.Err == nil:
+			sent++
+		case errors.Is(r.Err, ErrMaxBytes):
+			cutoff++
+		default:
+			t.Fatal(r.Err)
+		}
+	}
+	ensure.DeepEqual(t, sent, 3)
+	ensure.DeepEqual(t, cutoff, 1)
+	ensure.DeepEqual(t, requests.Load(), int64(3))
+}
+
+func TestBroadcastSendReport(t *testing.T) {
+	statuses := []int{http.StatusCreated, http.StatusGone, http.StatusTooManyRequests, http.StatusInternalServerError}
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					var i int
+					if _, err := fmt.Sscanf(path.Base(r.URL.Path), "%d", &i); err != nil {
+						t.Error(err)
+						return nil, err
+					}
+					if i%5 == 4 {
+						return nil, errors.New("connection reset")
+					}
+					return &http.Response{StatusCode: statuses[i%5]}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+	}
+	report, err := b.Send(context.Background(), []byte("test"), makeSubscriptions(40))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.Sent, 8)
+	for _, c := range []BroadcastCount{report.Gone, report.RateLimited, report.Failed, report.Transport} {
+		ensure.DeepEqual(t, c.Count, 8)
+		ensure.DeepEqual(t, len(c.Samples), maxReportSamples)
+	}
+	ensure.StringContains(t, report.Transport.Samples[0], "connection reset")
+	ensure.StringContains(t, report.RateLimited.Samples[0], "status=429")
+}
+
+func TestBroadcastSendReportUndispatched(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					cancel()
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+		Concurrency: 1,
+	}
+	report, err := b.Send(ctx, []byte("test"), makeSubscriptions(10))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.Sent, 1)
+	ensure.DeepEqual(t, report.Undispatched, 9)
+
+	report, err = b.Send(context.Background(), []byte("test"), makeSubscriptions(10))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.Sent, 10)
+	ensure.DeepEqual(t, report.Undispatched, 0)
+}
+
+func TestBroadcastAdaptiveConcurrency(t *testing.T) {
+	var requests, inFlight, maxInFlight atomic.Int64
+	var mu sync.Mutex
+	var limits []int
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					n := inFlight.Add(1)
+					defer inFlight.Add(-1)
+					for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+					}
+					time.Sleep(time.Millisecond)
+					if i := requests.Add(1); i > 30 && i <= 34 {
+						return &http.Response{StatusCode: http.StatusTooManyRequests}, nil
+					}
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+		Concurrency: 8,
+		AdaptiveConcurrency: &AdaptiveConcurrency{
+			Min: 1,
+			OnChange: func(limit int) {
+				mu.Lock()
+				defer mu.Unlock()
+				limits = append(limits, limit)
+			},
+		},
+	}
+	report, err := b.Send(context.Background(), []byte("test"), makeSubscriptions(100))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.Sent, 96)
+	ensure.DeepEqual(t, report.RateLimited.Count, 4)
+	ensure.True(t, maxInFlight.Load() <= 8, maxInFlight.Load())
+
+	// ramps up to the max, backs off on the 429s, then recovers
+	peak := slices.Index(limits, 8)
+	ensure.True(t, peak >= 0, limits)
+	ensure.DeepEqual(t, limits[:peak+1], []int{2, 3, 4, 5, 6, 7, 8})
+	low := slices.Min(limits[peak:])
+	ensure.True(t, low < 4, limits)
+	ensure.DeepEqual(t, limits[len(limits)-1], 8)
+}
+
+func TestBroadcastConcurrencyLimit(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int64
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					n := inFlight.Add(1)
+					defer inFlight.Add(-1)
+					for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+					}
+					time.Sleep(time.Millisecond)
+					return &http.Response{StatusCode: http.StatusTooManyRequests}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+		Concurrency: 3,
+	}
+	report, err := b.Send(context.Background(), []byte("test"), makeSubscriptions(30))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.RateLimited.Count, 30)
+	// a fixed Concurrency is not reduced by rate limiting
+	ensure.DeepEqual(t, maxInFlight.Load(), int64(3))
+}
+
+func TestBroadcastMaxInFlightBytes(t *testing.T) {
+	message := bytes.Repeat([]byte("x"), 3000)
+	recordLen := int64(minOverhead + len(message))
+	cases := []struct {
+		limit, peak int64
+	}{
+		{2*recordLen + recordLen/2, 2 * recordLen},
+		{recordLen / 2, recordLen},
+	}
+	for _, c := range cases {
+		var inFlight, peak, records, peakRecords atomic.Int64
+		b := &Broadcaster{
+			Client: &Client{
+				Client: &http.Client{
+					Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+						defer records.Add(-1)
+						n := inFlight.Add(r.ContentLength)
+						defer inFlight.Add(-r.ContentLength)
+						for m := peak.Load(); n > m && !peak.CompareAndSwap(m, n); m = peak.Load() {
+						}
+						if _, err := io.Copy(io.Discard, r.Body); err != nil {
+							t.Error(err)
+							return nil, err
+						}
+						time.Sleep(time.Millisecond)
+						return &http.Response{StatusCode: http.StatusCreated}, nil
+					}),
+				},
+				VAPIDKey:   validVapidKey,
+				Subscriber: validHTTPSSubscriber,
+				TTL:        time.Hour,
+				// counts the messages being encrypted or sent
+				Envelope: func(message []byte) ([]byte, error) {
+					n := records.Add(1)
+					for m := peakRecords.Load(); n > m && !peakRecords.CompareAndSwap(m, n); m = peakRecords.Load() {
+					}
+					return message, nil
+				},
+			},
+			MaxInFlightBytes: c.limit,
+		}
+		report, err := b.Send(context.Background(), message, makeSubscriptions(40))
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, report.Sent, 40)
+		ensure.DeepEqual(t, peak.Load(), c.peak)
+		ensure.DeepEqual(t, peakRecords.Load(), c.peak/recordLen)
+	}
+}
+
+func TestBroadcastMaxInFlightBytesCompress(t *testing.T) {
+	message := make([]byte, 3000)
+	_, err := rand.Read(message)
+	ensure.Nil(t, err)
+	var inFlight, peak atomic.Int64
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				n := inFlight.Add(r.ContentLength)
+				defer inFlight.Add(-r.ContentLength)
+				for m := peak.Load(); n > m && !peak.CompareAndSwap(m, n); m = peak.Load() {
+				}
+				time.Sleep(time.Millisecond)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Compress:   true,
+	}
+	// the incompressible record includes the flag byte, so two do not fit
+	recordLen := int64(len(message) + client.overhead())
+	b := &Broadcaster{Client: client, MaxInFlightBytes: 2*recordLen - 1}
+	report, err := b.Send(context.Background(), message, makeSubscriptions(20))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.Sent, 20)
+	ensure.DeepEqual(t, peak.Load(), recordLen)
+}
+
+func TestBroadcastVerifyLive(t *testing.T) {
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					if ttl, topic := r.Header.Get("TTL"), r.Header.Get("Topic"); ttl != "0" || topic != verifyTopic {
+						t.Errorf("unexpected TTL %q and Topic %q", ttl, topic)
+					}
+					var i int
+					if _, err := fmt.Sscanf(path.Base(r.URL.Path), "%d", &i); err != nil {
+						t.Error(err)
+						return nil, err
+					}
+					if i%2 == 1 {
+						return &http.Response{StatusCode: http.StatusGone}, nil
+					}
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+	}
+	subs := makeSubscriptions(10)
+	results := b.VerifyLive(context.Background(), subs)
+	ensure.DeepEqual(t, len(results), len(subs))
+	for _, r := range results {
+		var i int
+		_, err := fmt.Sscanf(path.Base(r.Subscription.Endpoint), "%d", &i)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, r.Live, i%2 == 0)
+		ensure.DeepEqual(t, r.Gone, i%2 == 1)
+	}
+	ensure.DeepEqual(t, b.Client.TTL, time.Hour)
+}
+
+func TestBroadcastMaxOrigins(t *testing.T) {
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					t.Error("unexpected request")
+					return nil, errors.New("unexpected request")
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+		MaxOrigins: 2,
+	}
+	var subs []*Subscription
+	for _, host := range []string{"a.push.server", "b.push.server", "c.push.server"} {
+		sub := validSubscription
+		sub.Endpoint = "https://" + host + "/capability-url"
+		subs = append(subs, &sub)
+	}
+	_, err := b.Send(context.Background(), []byte("test"), subs)
+	ensure.True(t, errors.Is(err, ErrMaxOrigins), err)
+
+	// hosts differing only in case are the same origin
+	ensure.Nil(t, b.checkOrigins([]*Subscription{
+		{Endpoint: "https://a.push.server/1"},
+		{Endpoint: "https://A.Push.Server/2"},
+		{Endpoint: "https://b.push.server/3"},
+	}))
+
+	var results int
+	for r := range b.Stream(context.Background(), []byte("test"), subs) {
+		ensure.True(t, errors.Is(r.Err, ErrMaxOrigins), r.Err)
+		results++
+	}
+	ensure.DeepEqual(t, results, len(subs))
+}
+
+func TestBroadcastDedupEndpoints(t *testing.T) {
+	var sent atomic.Int64
+	b := &Broadcaster{
+		Client: &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					sent.Add(1)
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}),
+			},
+			VAPIDKey:   validVapidKey,
+			Subscriber: validHTTPSSubscriber,
+			TTL:        time.Hour,
+		},
+		DedupEndpoints: true,
+	}
+	duplicate := validSubscription
+	duplicate.Endpoint = "https://THE.push.server/capability-url"
+	subs := []*Subscription{&validSubscription, &duplicate, &validSubscription}
+	report, err := b.Send(context.Background(), []byte("test"), subs)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, sent.Load(), int64(1))
+	ensure.DeepEqual(t, report.Sent, 1)
+	ensure.DeepEqual(t, report.Duplicates, 2)
+
+	var results int
+	for range b.Stream(context.Background(), []byte("test"), subs) {
+		results++
+	}
+	ensure.DeepEqual(t, results, 1)
+}
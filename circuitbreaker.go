@@ -0,0 +1,149 @@
+package webpush
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitThreshold = 5
+	defaultCircuitCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without making a request when the CircuitBreaker
+// is open for the origin of the Endpoint.
+var ErrCircuitOpen = errors.New("webpush: circuit open for push endpoint origin")
+
+// CircuitBreaker stops sending to a Push Service origin after Threshold
+// consecutive failures, which are network errors and 5xx responses. Sends to
+// the origin then fail with ErrCircuitOpen for the Cooldown, after which a
+// single request is let through to check for recovery. If it succeeds the
+// breaker closes, otherwise it stays open for another Cooldown. Requests
+// abandoned because their context was done do not count as failures.
+//
+// A CircuitBreaker is safe for concurrent use and may be shared by Clients. It
+// must not be copied after first use.
+type CircuitBreaker struct {
+	Threshold int           // Optional consecutive failures to open, defaults to 5.
+	Cooldown  time.Duration // Optional time the breaker stays open, defaults to 30 seconds.
+
+	mu      sync.Mutex
+	origins map[string]*circuit
+}
+
+// circuit is the state of the breaker for an origin.
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *CircuitBreaker) threshold() int {
+	if b.Threshold <= 0 {
+		return defaultCircuitThreshold
+	}
+	return b.Threshold
+}
+
+// allow returns ErrCircuitOpen if a request to the origin should fail fast,
+// marking the request as the recovery check if the Cooldown has passed.
+func (b *CircuitBreaker) allow(origin string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.origins[origin]
+	if c == nil || c.failures < b.threshold() {
+		return nil
+	}
+	if c.probing || timeNow().Before(c.openUntil) {
+		return ErrCircuitOpen
+	}
+	c.probing = true
+	return nil
+}
+
+// record updates the state for the origin with the outcome of a request.
+func (b *CircuitBreaker) record(req *http.Request, origin string, res *http.Response, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.origins[origin]
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		if c != nil {
+			c.probing = false
+		}
+	case err == nil && res.StatusCode < 500:
+		delete(b.origins, origin)
+	default:
+		if c == nil {
+			if b.origins == nil {
+				b.origins = make(map[string]*circuit)
+			}
+			c = &circuit{}
+			b.origins[origin] = c
+		}
+		c.failures++
+		c.probing = false
+		if c.failures >= b.threshold() {
+			cooldown := b.Cooldown
+			if cooldown <= 0 {
+				cooldown = defaultCircuitCooldown
+			}
+			c.openUntil = timeNow().Add(cooldown)
+		}
+	}
+}
+
+// Open reports if the breaker is currently open for the origin.
+func (b *CircuitBreaker) Open(origin string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.origins[origin]
+	return c != nil && c.failures >= b.threshold() && (c.probing || timeNow().Before(c.openUntil))
+}
+
+// circuitState is the exported state of the breaker for an origin.
+type circuitState struct {
+	Failures  int       `json:"failures"`
+	OpenUntil time.Time `json:"openUntil,omitzero"`
+}
+
+// ExportState returns the state of the breaker for every origin with recent
+// failures as JSON, so a restarted process can resume with it using
+// ImportState.
+func (b *CircuitBreaker) ExportState() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	origins := make(map[string]circuitState, len(b.origins))
+	for origin, c := range b.origins {
+		origins[origin] = circuitState{Failures: c.failures, OpenUntil: c.openUntil}
+	}
+	state, _ := json.Marshal(map[string]any{"origins": origins})
+	return state
+}
+
+// ImportState replaces the state of the breaker with one returned by
+// ExportState. An in progress recovery check is not part of the state, so an
+// origin whose Cooldown has passed allows a new one.
+func (b *CircuitBreaker) ImportState(state []byte) error {
+	var imported struct {
+		Origins map[string]circuitState `json:"origins"`
+	}
+	if err := json.Unmarshal(state, &imported); err != nil {
+		return fmt.Errorf("webpush: invalid circuit breaker state: %w", err)
+	}
+	origins := make(map[string]*circuit, len(imported.Origins))
+	for origin, c := range imported.Origins {
+		if c.Failures <= 0 {
+			return fmt.Errorf("webpush: invalid circuit breaker state for %q: failures of %v", origin, c.Failures)
+		}
+		origins[origin] = &circuit{failures: c.Failures, openUntil: c.OpenUntil}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.origins = origins
+	return nil
+}
@@ -0,0 +1,149 @@
+package webpush
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	pinTime(t, goldTime)
+	failing := true
+	var requests int
+	breaker := &CircuitBreaker{Threshold: 3, Cooldown: time.Minute}
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				requests++
+				if failing && r.URL.Host == "the.push.server" {
+					return &http.Response{StatusCode: http.StatusServiceUnavailable}, nil
+				}
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:       validVapidKey,
+		Subscriber:     validHTTPSSubscriber,
+		TTL:            time.Hour,
+		CircuitBreaker: breaker,
+	}
+	other := validSubscription
+	other.Endpoint = "https://other.push.server/capability-url"
+	ctx := context.Background()
+
+	for range 3 {
+		err := client.Send(ctx, []byte("test"), &validSubscription)
+		ensure.False(t, errors.Is(err, ErrCircuitOpen))
+		ensure.NotNil(t, err)
+	}
+	ensure.True(t, breaker.Open(validSubscriptionEndpointOrigin))
+	err := client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, ErrCircuitOpen), err)
+	ensure.DeepEqual(t, requests, 3)
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &other))
+	ensure.DeepEqual(t, requests, 4)
+
+	// a failed recovery check opens the breaker for another cooldown
+	pinTime(t, goldTime.Add(time.Minute))
+	err = client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.False(t, errors.Is(err, ErrCircuitOpen))
+	ensure.DeepEqual(t, requests, 5)
+	err = client.SendAndForget(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, ErrCircuitOpen), err)
+	ensure.DeepEqual(t, requests, 5)
+
+	// a successful recovery check closes the breaker
+	pinTime(t, goldTime.Add(2*time.Minute))
+	failing = false
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.False(t, breaker.Open(validSubscriptionEndpointOrigin))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, requests, 7)
+}
+
+func TestCircuitBreakerIgnoresCancelled(t *testing.T) {
+	breaker := &CircuitBreaker{Threshold: 1}
+	client := &Client{
+		VAPIDKey:       validVapidKey,
+		Subscriber:     validHTTPSSubscriber,
+		TTL:            time.Hour,
+		CircuitBreaker: breaker,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client.Client = &http.Client{
+		Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+			cancel()
+			return nil, r.Context().Err()
+		}),
+	}
+	err := client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, context.Canceled), err)
+	ensure.False(t, breaker.Open(validSubscriptionEndpointOrigin))
+
+	client.Client.Transport = transportFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection reset")
+	})
+	err = client.Send(context.Background(), []byte("test"), &validSubscription)
+	ensure.False(t, errors.Is(err, ErrCircuitOpen))
+	ensure.True(t, breaker.Open(validSubscriptionEndpointOrigin))
+}
+
+func TestCircuitBreakerState(t *testing.T) {
+	pinTime(t, goldTime)
+	newClient := func(breaker *CircuitBreaker, requests *int) *Client {
+		return &Client{
+			Client: &http.Client{
+				Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+					*requests++
+					return &http.Response{StatusCode: http.StatusBadGateway}, nil
+				}),
+			},
+			VAPIDKey:       validVapidKey,
+			Subscriber:     validHTTPSSubscriber,
+			TTL:            time.Hour,
+			CircuitBreaker: breaker,
+		}
+	}
+	other := validSubscription
+	other.Endpoint = "https://other.push.server/capability-url"
+	ctx := context.Background()
+
+	var requests int
+	breaker := &CircuitBreaker{Threshold: 2, Cooldown: time.Minute}
+	client := newClient(breaker, &requests)
+	for _, s := range []*Subscription{&validSubscription, &validSubscription, &other} {
+		_ = client.Send(ctx, []byte("test"), s)
+	}
+	ensure.True(t, breaker.Open(validSubscriptionEndpointOrigin))
+	ensure.False(t, breaker.Open("https://other.push.server"))
+	state := breaker.ExportState()
+
+	restored := &CircuitBreaker{Threshold: 2, Cooldown: time.Minute}
+	ensure.Nil(t, restored.ImportState(state))
+	requests = 0
+	client = newClient(restored, &requests)
+	err := client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, ErrCircuitOpen), err)
+	ensure.DeepEqual(t, requests, 0)
+
+	// the failure count is restored, so one more failure opens the breaker
+	err = client.Send(ctx, []byte("test"), &other)
+	ensure.False(t, errors.Is(err, ErrCircuitOpen))
+	ensure.True(t, restored.Open("https://other.push.server"))
+
+	// the cooldown is restored too
+	pinTime(t, goldTime.Add(time.Minute))
+	ensure.False(t, restored.Open(validSubscriptionEndpointOrigin))
+}
+
+func TestCircuitBreakerImportStateErrors(t *testing.T) {
+	b := &CircuitBreaker{}
+	ensure.Err(t, b.ImportState([]byte("{")), regexp.MustCompile("invalid circuit breaker state"))
+	err := b.ImportState([]byte(`{"origins":{"https://the.push.server":{"failures":0}}}`))
+	ensure.Err(t, err, regexp.MustCompile("failures of 0"))
+	ensure.Nil(t, b.ImportState(b.ExportState()))
+}
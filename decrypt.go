@@ -0,0 +1,95 @@
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// DecryptOptions are optional parameters for DecryptWithOptions.
+type DecryptOptions struct {
+	// WebPushInfo, ContentEncryptionKeyInfo and NonceInfo optionally override
+	// the HKDF info strings, and must match the EncryptOptions used to encrypt
+	// the record.
+	WebPushInfo              []byte
+	ContentEncryptionKeyInfo []byte
+	NonceInfo                []byte
+}
+
+// Decrypt decrypts a single record aes128gcm encoded message, as sent by Send,
+// using the User Agent private key and auth secret. This is the receiving side
+// of the encryption, and is primarily useful for testing.
+func Decrypt(record []byte, userAgentPrivateKey *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	return DecryptWithOptions(record, userAgentPrivateKey, authSecret, nil)
+}
+
+// DecryptWithOptions is Decrypt with optional parameters, which is useful to
+// decrypt records encrypted with overridden EncryptOptions info strings. The
+// options may be nil.
+func DecryptWithOptions(record []byte, userAgentPrivateKey *ecdh.PrivateKey, authSecret []byte, opts *DecryptOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &DecryptOptions{}
+	}
+	if len(record) < headerLen {
+		return nil, fmt.Errorf("webpush: record length of %v is shorter than the header", len(record))
+	}
+	salt := record[:16]
+	recordSize := binary.BigEndian.Uint32(record[16:20])
+	if record[20] != publicKeyLen {
+		return nil, fmt.Errorf("webpush: invalid key id length of %v", record[20])
+	}
+	appServerPublicKeyBytes := record[21:headerLen]
+	ciphertext := record[headerLen:]
+	if uint64(len(ciphertext)) > uint64(recordSize) {
+		return nil, fmt.Errorf(
+			"webpush: ciphertext length of %v exceeds record size of %v", len(ciphertext), recordSize)
+	}
+
+	appServerPublicKey, err := ecdh.P256().NewPublicKey(appServerPublicKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid application server public key: %w", err)
+	}
+	sharedSecret, err := userAgentPrivateKey.ECDH(appServerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to derive shared secret: %w", err)
+	}
+
+	keyInfo := slices.Concat(orDefault(opts.WebPushInfo, webPushInfo), userAgentPrivateKey.PublicKey().Bytes(), appServerPublicKeyBytes)
+	ikm, err := hkdfExpand(32, sharedSecret, authSecret, keyInfo)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to derive ikm: %w", err)
+	}
+	contentEncryptionKey, err := hkdfExpand(16, ikm, salt, orDefault(opts.ContentEncryptionKeyInfo, contentEncryptionKeyInfo))
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to derive content encryption key: %w", err)
+	}
+	nonce, err := hkdfExpand(12, ikm, salt, orDefault(opts.NonceInfo, nonceInfo))
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to derive nonce: %w", err)
+	}
+
+	aesCipher, err := aes.NewCipher(contentEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid derived content encryption key: %w", err)
+	}
+	gcm, err := cipher.NewGCM(aesCipher)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid content encryption cipher: %w", err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to decrypt record: %w", err)
+	}
+
+	// strip the padding and the delimiter, which must indicate the final record
+	unpadded := bytes.TrimRight(plaintext, "\x00")
+	if len(unpadded) == 0 || unpadded[len(unpadded)-1] != '\x02' {
+		return nil, errors.New("webpush: invalid padding delimiter in record")
+	}
+	return unpadded[:len(unpadded)-1], nil
+}
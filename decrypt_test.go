@@ -0,0 +1,97 @@
+package webpush
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func rfc8291Keys(t testing.TB) (*ecdh.PrivateKey, []byte) {
+	t.Helper()
+	privateKey, err := ecdh.P256().NewPrivateKey(
+		must(base64.RawURLEncoding.DecodeString(rfc8291UserAgentPrivateKey)))
+	ensure.Nil(t, err)
+	return privateKey, must(base64.RawURLEncoding.DecodeString(rfc8291Subscription.Keys.Auth))
+}
+
+func TestDecryptRFC8291Vector(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	record := must(base64.RawURLEncoding.DecodeString(rfc8291Body))
+	plaintext, err := Decrypt(record, privateKey, authSecret)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(plaintext), rfc8291Plaintext)
+}
+
+func TestDecryptSendRoundTrip(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	var record []byte
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				var err error
+				record, err = io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("round trip"), &rfc8291Subscription))
+	plaintext, err := Decrypt(record, privateKey, authSecret)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(plaintext), "round trip")
+}
+
+func TestDecryptErrors(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	valid := must(base64.RawURLEncoding.DecodeString(rfc8291Body))
+	cases := []struct {
+		label  string
+		modify func([]byte) []byte
+		err    string
+	}{
+		{"short header", func(b []byte) []byte { return b[:headerLen-1] }, "shorter than the header"},
+		{"key id length", func(b []byte) []byte { b[20] = 64; return b }, "invalid key id length"},
+		{"record size", func(b []byte) []byte { b[18], b[19] = 0, 1; return b }, "exceeds record size"},
+		{"bad key", func(b []byte) []byte { b[21] = 0; return b }, "invalid application server public key"},
+		{"flipped tag", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, "failed to decrypt"},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-1] }, "failed to decrypt"},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			_, err := Decrypt(c.modify(append([]byte(nil), valid...)), privateKey, authSecret)
+			ensure.Err(t, err, regexp.MustCompile(c.err))
+		})
+	}
+
+	_, err := Decrypt(valid, privateKey, make([]byte, 16))
+	ensure.Err(t, err, regexp.MustCompile("failed to decrypt"))
+}
+
+func FuzzDecrypt(f *testing.F) {
+	privateKey, authSecret := rfc8291Keys(f)
+	valid := must(base64.RawURLEncoding.DecodeString(rfc8291Body))
+	f.Add(valid)
+	f.Add(valid[:headerLen])
+	f.Add(valid[:len(valid)-1])
+	f.Fuzz(func(t *testing.T, record []byte) {
+		plaintext, err := Decrypt(record, privateKey, authSecret)
+		if err != nil {
+			ensure.True(t, plaintext == nil)
+			return
+		}
+		// the salt, key id and ciphertext are authenticated, only the record
+		// size may differ from the valid record
+		ensure.DeepEqual(t, string(plaintext), rfc8291Plaintext)
+		ensure.DeepEqual(t, record[headerLen:], valid[headerLen:])
+	})
+}
@@ -0,0 +1,262 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Replaced in tests to pin the salt.
+var saltReader = rand.Reader
+
+// AEAD creates the AES-128-GCM cipher used to encrypt the record, allowing for
+// the use of a validated cryptographic module, such as one required for FIPS.
+type AEAD interface {
+	// NewGCM returns the AES-128-GCM cipher for the 16 byte key.
+	NewGCM(key []byte) (cipher.AEAD, error)
+}
+
+// KDF derives the keys used to encrypt the record, allowing for the use of a
+// validated cryptographic module, such as one required for FIPS.
+type KDF interface {
+	// Derive returns length bytes of HKDF-SHA-256 output for the secret, salt
+	// and info.
+	Derive(secret, salt, info []byte, length int) ([]byte, error)
+}
+
+// stdAEAD is the AEAD using crypto/aes and crypto/cipher.
+type stdAEAD struct{}
+
+func (stdAEAD) NewGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// stdKDF is the KDF using golang.org/x/crypto/hkdf.
+type stdKDF struct{}
+
+func (stdKDF) Derive(secret, salt, info []byte, length int) ([]byte, error) {
+	return hkdfExpand(length, secret, salt, info)
+}
+
+// EncryptOptions are the optional parameters for Encrypt.
+type EncryptOptions struct {
+	RecordSize int // Optional record size advertised in the header, defaults to 4096.
+
+	// ECDH optionally derives the shared secret, as with the Client ECDH.
+	ECDH func(userAgentPublicKey *ecdh.PublicKey) (sharedSecret, appServerPublicKey []byte, err error)
+
+	// AppServerKey optionally fixes the application server key instead of
+	// generating an ephemeral one, which is only useful to reproduce test
+	// vectors such as RFC 8291 Appendix A. Reusing a key across messages is
+	// insecure. It cannot be combined with ECDH.
+	AppServerKey *ecdh.PrivateKey
+
+	// NonceGuard is optionally consulted with the derived key and nonce.
+	NonceGuard NonceGuard
+
+	// WebPushInfo, ContentEncryptionKeyInfo and NonceInfo optionally override
+	// the HKDF info strings, which default to the RFC 8291 values. Changing
+	// them breaks compatibility with every User Agent, and is only useful to
+	// experiment with new encodings.
+	WebPushInfo              []byte
+	ContentEncryptionKeyInfo []byte
+	NonceInfo                []byte
+
+	// AEAD and KDF optionally replace the standard library AES-128-GCM and
+	// the HKDF implementations.
+	AEAD AEAD
+	KDF  KDF
+}
+
+// Encrypt encrypts the message for the Subscription as a single record
+// aes128gcm encoded message, as sent by Send. It is the low level building
+// block for Send and the reverse of Decrypt. The options may be nil.
+func Encrypt(message []byte, s *Subscription, opts *EncryptOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &EncryptOptions{}
+	}
+	return encrypt(message, &PreparedSubscription{Subscription: s}, opts)
+}
+
+func encrypt(message []byte, p *PreparedSubscription, o *EncryptOptions) ([]byte, error) {
+	recordSize := o.RecordSize
+	if recordSize == 0 {
+		recordSize = maxRecordSize
+	}
+	keyInfoPrefix := orDefault(o.WebPushInfo, webPushInfo)
+	cekInfo := orDefault(o.ContentEncryptionKeyInfo, contentEncryptionKeyInfo)
+	nonceDerivationInfo := orDefault(o.NonceInfo, nonceInfo)
+	var aead AEAD = stdAEAD{}
+	if o.AEAD != nil {
+		aead = o.AEAD
+	}
+	var kdf KDF = stdKDF{}
+	if o.KDF != nil {
+		kdf = o.KDF
+	}
+
+	if len(message) > recordSize-minOverhead {
+		return nil, fmt.Errorf(
+			"webpush: message length of %v is too long for record size of %v",
+			len(message), recordSize)
+	}
+
+	if err := p.decode(); err != nil {
+		return nil, err
+	}
+	authSecret := p.authSecret
+	userAgentPublicKey, userAgentPublicKeyBytes := p.userAgentPublicKey, p.userAgentPublicKeyBytes
+
+	// AES-GCM must never reuse a (key, nonce) pair. Both are derived from the
+	// salt and the application server key, which must therefore be fresh for
+	// every message, even when sending to the same Subscription repeatedly.
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(saltReader, salt); err != nil {
+		return nil, fmt.Errorf("webpush: failed to create salt: %w", err)
+	}
+
+	// Derive Shared Secret for this Message
+	var sharedSecret, appServerPublicKeyBytes []byte
+	var err error
+	switch {
+	case o.AppServerKey != nil && o.ECDH != nil:
+		return nil, errors.New("webpush: only one of ECDH and AppServerKey may be set")
+	case o.AppServerKey != nil:
+		sharedSecret, err = o.AppServerKey.ECDH(userAgentPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("webpush: failed to derive shared secret: %w", err)
+		}
+		appServerPublicKeyBytes = o.AppServerKey.PublicKey().Bytes()
+	case o.ECDH == nil:
+		sharedSecret, appServerPublicKeyBytes, err = ephemeralECDH(userAgentPublicKey)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		sharedSecret, appServerPublicKeyBytes, err = o.ECDH(userAgentPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("webpush: failed to derive shared secret: %w", err)
+		}
+		if len(appServerPublicKeyBytes) != publicKeyLen {
+			return nil, fmt.Errorf(
+				"webpush: invalid application server public key length of %v",
+				len(appServerPublicKeyBytes))
+		}
+	}
+
+	// Derive IKM
+	keyInfo := slices.Concat(keyInfoPrefix, userAgentPublicKeyBytes, appServerPublicKeyBytes)
+	ikm, err := kdf.Derive(sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to derive ikm: %w", err)
+	}
+
+	// Derive Content Encryption Key
+	contentEncryptionKey, err := kdf.Derive(ikm, salt, cekInfo, 16)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to derive content encryption key: %w", err)
+	}
+
+	// Derive Nonce
+	nonce, err := kdf.Derive(ikm, salt, nonceDerivationInfo, 12)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to derive nonce: %w", err)
+	}
+
+	if o.NonceGuard != nil {
+		if err := o.NonceGuard.Check(contentEncryptionKey, nonce); err != nil {
+			return nil, err
+		}
+	}
+
+	// AES + GCM
+	gcm, err := aead.NewGCM(contentEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid content encryption cipher: %w", err)
+	}
+	if gcm.NonceSize() != len(nonce) || gcm.Overhead() != TagLen {
+		return nil, fmt.Errorf(
+			"webpush: invalid content encryption cipher with nonce size %v and overhead %v",
+			gcm.NonceSize(), gcm.Overhead())
+	}
+
+	// Single allocation byte slice in which we write the header, message,
+	// delimiter and padding. The record is sized to fit the message and is not
+	// padded to the record size, which is only advertised in the header as the
+	// upper bound for the single final record. We then Seal the message and
+	// write the resulting ciphertext replacing the plaintext message in the
+	// same byte slice.
+	record := make([]byte, 0, minOverhead+len(message))
+	record = append(record, salt...)
+	record = binary.BigEndian.AppendUint32(record, uint32(recordSize))
+	record = append(record, byte(len(appServerPublicKeyBytes)))
+	record = append(record, appServerPublicKeyBytes...)
+	record = append(record, message...)
+	record = append(record, '\x02')
+	gcm.Seal(
+		// replace plaintext in-place with ciphertext
+		record[headerLen:headerLen],
+		nonce,
+		// pad until capacity accounting for overhead
+		record[headerLen:cap(record)-gcm.Overhead()],
+		nil)
+	record = record[0:cap(record)] // resize to header + gcm overhead
+
+	return record, nil
+}
+
+// orDefault returns v, or def if v is empty.
+func orDefault(v, def []byte) []byte {
+	if len(v) == 0 {
+		return def
+	}
+	return v
+}
+
+// EncryptResult is the outcome of encrypting for a single Subscription.
+type EncryptResult struct {
+	Subscription *Subscription
+	Record       []byte // The encrypted record, as returned by Encrypt.
+	Err          error
+}
+
+// EncryptMany encrypts the message for each Subscription in parallel, which
+// separates the CPU bound encryption from sending for large broadcasts. The
+// results are in the same order as subs. The record size defaults to 4096 and
+// the concurrency to GOMAXPROCS.
+func EncryptMany(message []byte, subs []*Subscription, recordSize, concurrency int) []EncryptResult {
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	opts := &EncryptOptions{RecordSize: recordSize}
+	results := make([]EncryptResult, len(subs))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(concurrency, len(subs)) {
+		wg.Go(func() {
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(subs) {
+					return
+				}
+				record, err := Encrypt(message, subs[i], opts)
+				results[i] = EncryptResult{Subscription: subs[i], Record: record, Err: err}
+			}
+		})
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,228 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func rfc8291EncryptOptions(t testing.TB) *EncryptOptions {
+	t.Helper()
+	return &EncryptOptions{
+		AppServerKey: must(ecdh.P256().NewPrivateKey(
+			must(base64.RawURLEncoding.DecodeString(rfc8291AppServerPrivateKey)))),
+	}
+}
+
+func TestEncryptRFC8291Vector(t *testing.T) {
+	pinSalt(t, must(base64.RawURLEncoding.DecodeString(rfc8291Salt)))
+	record, err := Encrypt([]byte(rfc8291Plaintext), &rfc8291Subscription, rfc8291EncryptOptions(t))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, base64.RawURLEncoding.EncodeToString(record), rfc8291Body)
+}
+
+func TestEncryptDefaultInfo(t *testing.T) {
+	ensure.DeepEqual(t, string(webPushInfo), "WebPush: info\x00")
+	ensure.DeepEqual(t, string(contentEncryptionKeyInfo), "Content-Encoding: aes128gcm\x00")
+	ensure.DeepEqual(t, string(nonceInfo), "Content-Encoding: nonce\x00")
+
+	salt := must(base64.RawURLEncoding.DecodeString(rfc8291Salt))
+	pinSalt(t, slices.Concat(salt, salt))
+	opts := rfc8291EncryptOptions(t)
+	opts.WebPushInfo = webPushInfo
+	opts.ContentEncryptionKeyInfo = contentEncryptionKeyInfo
+	opts.NonceInfo = nonceInfo
+	record, err := Encrypt([]byte(rfc8291Plaintext), &rfc8291Subscription, opts)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, base64.RawURLEncoding.EncodeToString(record), rfc8291Body)
+
+	// the override is used, so the standard Decrypt fails
+	opts.NonceInfo = []byte("Content-Encoding: experimental-nonce\x00")
+	record, err = Encrypt([]byte(rfc8291Plaintext), &rfc8291Subscription, opts)
+	ensure.Nil(t, err)
+	ensure.NotDeepEqual(t, base64.RawURLEncoding.EncodeToString(record), rfc8291Body)
+	privateKey, authSecret := rfc8291Keys(t)
+	_, err = Decrypt(record, privateKey, authSecret)
+	ensure.Err(t, err, regexp.MustCompile("failed to decrypt"))
+}
+
+func TestEncryptInfoRoundTrip(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	info := DecryptOptions{
+		WebPushInfo:              []byte("WebPush: experimental info\x00"),
+		ContentEncryptionKeyInfo: []byte("Content-Encoding: experimental\x00"),
+		NonceInfo:                []byte("Content-Encoding: experimental-nonce\x00"),
+	}
+	record, err := Encrypt([]byte("round trip"), &rfc8291Subscription, &EncryptOptions{
+		WebPushInfo:              info.WebPushInfo,
+		ContentEncryptionKeyInfo: info.ContentEncryptionKeyInfo,
+		NonceInfo:                info.NonceInfo,
+	})
+	ensure.Nil(t, err)
+	plaintext, err := DecryptWithOptions(record, privateKey, authSecret, &info)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(plaintext), "round trip")
+
+	// each info string is used in the derivation
+	for _, reset := range []func(o *DecryptOptions){
+		func(o *DecryptOptions) { o.WebPushInfo = nil },
+		func(o *DecryptOptions) { o.ContentEncryptionKeyInfo = nil },
+		func(o *DecryptOptions) { o.NonceInfo = nil },
+	} {
+		opts := info
+		reset(&opts)
+		_, err := DecryptWithOptions(record, privateKey, authSecret, &opts)
+		ensure.Err(t, err, regexp.MustCompile("failed to decrypt"))
+	}
+}
+
+type spyAEAD struct {
+	AEAD
+	calls int
+}
+
+func (a *spyAEAD) NewGCM(key []byte) (cipher.AEAD, error) {
+	a.calls++
+	return a.AEAD.NewGCM(key)
+}
+
+type spyKDF struct {
+	KDF
+	lengths []int
+}
+
+func (k *spyKDF) Derive(secret, salt, info []byte, length int) ([]byte, error) {
+	k.lengths = append(k.lengths, length)
+	return k.KDF.Derive(secret, salt, info, length)
+}
+
+// invertedKeyAEAD is AES-128-GCM with the bits of the key inverted.
+type invertedKeyAEAD struct{}
+
+func (invertedKeyAEAD) NewGCM(key []byte) (cipher.AEAD, error) {
+	inverted := make([]byte, len(key))
+	for i, b := range key {
+		inverted[i] = ^b
+	}
+	return stdAEAD{}.NewGCM(inverted)
+}
+
+type aeadFunc func(key []byte) (cipher.AEAD, error)
+
+func (f aeadFunc) NewGCM(key []byte) (cipher.AEAD, error) {
+	return f(key)
+}
+
+func TestEncryptAEADAndKDF(t *testing.T) {
+	salt := must(base64.RawURLEncoding.DecodeString(rfc8291Salt))
+	pinSalt(t, slices.Concat(salt, salt))
+	aead := &spyAEAD{AEAD: stdAEAD{}}
+	kdf := &spyKDF{KDF: stdKDF{}}
+	opts := rfc8291EncryptOptions(t)
+	opts.AEAD = aead
+	opts.KDF = kdf
+	record, err := Encrypt([]byte(rfc8291Plaintext), &rfc8291Subscription, opts)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, base64.RawURLEncoding.EncodeToString(record), rfc8291Body)
+	ensure.DeepEqual(t, aead.calls, 1)
+	ensure.DeepEqual(t, kdf.lengths, []int{32, 16, 12})
+
+	// the alternate AEAD is used, so the standard Decrypt fails
+	opts.AEAD = invertedKeyAEAD{}
+	record, err = Encrypt([]byte(rfc8291Plaintext), &rfc8291Subscription, opts)
+	ensure.Nil(t, err)
+	ensure.NotDeepEqual(t, base64.RawURLEncoding.EncodeToString(record), rfc8291Body)
+	privateKey, authSecret := rfc8291Keys(t)
+	_, err = Decrypt(record, privateKey, authSecret)
+	ensure.Err(t, err, regexp.MustCompile("failed to decrypt"))
+}
+
+func TestEncryptAEADErrors(t *testing.T) {
+	opts := &EncryptOptions{AEAD: aeadFunc(func([]byte) (cipher.AEAD, error) {
+		return nil, errors.New("module unavailable")
+	})}
+	_, err := Encrypt([]byte("test"), &validSubscription, opts)
+	ensure.Err(t, err, regexp.MustCompile("invalid content encryption cipher: module unavailable"))
+
+	opts.AEAD = aeadFunc(func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCMWithTagSize(block, 12)
+	})
+	_, err = Encrypt([]byte("test"), &validSubscription, opts)
+	ensure.Err(t, err, regexp.MustCompile("overhead 12"))
+}
+
+func TestEncryptErrors(t *testing.T) {
+	_, err := Encrypt(make([]byte, maxRecordSize), &validSubscription, nil)
+	ensure.Err(t, err, regexp.MustCompile("too long"))
+	_, err = Encrypt([]byte("test"), &Subscription{}, nil)
+	ensure.Err(t, err, regexp.MustCompile("invalid user agent public key"))
+
+	opts := rfc8291EncryptOptions(t)
+	opts.ECDH = ephemeralECDH
+	_, err = Encrypt([]byte("test"), &rfc8291Subscription, opts)
+	ensure.Err(t, err, regexp.MustCompile("only one of ECDH and AppServerKey"))
+}
+
+func TestEncryptECDH(t *testing.T) {
+	pinSalt(t, must(base64.RawURLEncoding.DecodeString(rfc8291Salt)))
+	appServerKey := rfc8291EncryptOptions(t).AppServerKey
+	opts := &EncryptOptions{
+		ECDH: func(userAgentPublicKey *ecdh.PublicKey) ([]byte, []byte, error) {
+			sharedSecret, err := appServerKey.ECDH(userAgentPublicKey)
+			return sharedSecret, appServerKey.PublicKey().Bytes(), err
+		},
+	}
+	record, err := Encrypt([]byte(rfc8291Plaintext), &rfc8291Subscription, opts)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, base64.RawURLEncoding.EncodeToString(record), rfc8291Body)
+}
+
+func TestEncryptMany(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	subs := make([]*Subscription, 20)
+	for i := range subs {
+		sub := rfc8291Subscription
+		sub.Endpoint = fmt.Sprintf("%s/%d", rfc8291Subscription.Endpoint, i)
+		subs[i] = &sub
+	}
+	invalid := &Subscription{Endpoint: "https://the.push.server/invalid"}
+	subs = append(subs, invalid)
+
+	results := EncryptMany([]byte("broadcast"), subs, 0, 4)
+	ensure.DeepEqual(t, len(results), len(subs))
+	for i, r := range results[:len(results)-1] {
+		ensure.True(t, r.Subscription == subs[i])
+		ensure.Nil(t, r.Err)
+		ensure.DeepEqual(t, string(must(Decrypt(r.Record, privateKey, authSecret))), "broadcast")
+	}
+	last := results[len(results)-1]
+	ensure.True(t, last.Subscription == invalid)
+	ensure.Err(t, last.Err, regexp.MustCompile("invalid user agent public key"))
+}
+
+func BenchmarkEncryptMany(b *testing.B) {
+	subs := make([]*Subscription, 256)
+	for i := range subs {
+		subs[i] = &validSubscription
+	}
+	for _, concurrency := range []int{1, 0} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				EncryptMany([]byte("test"), subs, 0, concurrency)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package webpush
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ClientFromEnv returns a Client configured from environment variables named
+// by the prefix followed by:
+//
+//   - VAPID_KEY, the required private key as returned by GenerateVAPIDKey.
+//   - SUBSCRIBER, the required https URL or mailto: email address.
+//   - TTL, the required TTL as parsed by time.ParseDuration.
+//   - TOPIC, the optional Topic.
+//   - URGENCY, the optional Urgency.
+//   - RECORD_SIZE, the optional RecordSize.
+//   - USER_AGENT, the optional User-Agent.
+//   - PREFER, the optional Prefer header.
+//
+// For example ClientFromEnv("WEBPUSH_") reads WEBPUSH_VAPID_KEY. The http
+// Client is left for the caller to set.
+func ClientFromEnv(prefix string) (*Client, error) {
+	env := func(name string) string {
+		return os.Getenv(prefix + name)
+	}
+
+	vapidKey := env("VAPID_KEY")
+	if vapidKey == "" {
+		return nil, fmt.Errorf("webpush: missing %vVAPID_KEY", prefix)
+	}
+	key, err := ParseVAPIDKey(vapidKey)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid %vVAPID_KEY: %w", prefix, err)
+	}
+	c := &Client{
+		VAPIDKey:   key,
+		Subscriber: env("SUBSCRIBER"),
+		Topic:      env("TOPIC"),
+		Urgency:    Urgency(env("URGENCY")),
+		UserAgent:  env("USER_AGENT"),
+		Prefer:     env("PREFER"),
+	}
+	if !validSubscriber(c.Subscriber) {
+		return nil, fmt.Errorf("webpush: invalid %vSUBSCRIBER: %q", prefix, c.Subscriber)
+	}
+
+	ttl := env("TTL")
+	if ttl == "" {
+		return nil, fmt.Errorf("webpush: missing %vTTL", prefix)
+	}
+	if c.TTL, err = time.ParseDuration(ttl); err != nil {
+		return nil, fmt.Errorf("webpush: invalid %vTTL: %w", prefix, err)
+	}
+	if c.TTL < 0 {
+		return nil, fmt.Errorf("webpush: invalid %vTTL: %q is negative", prefix, ttl)
+	}
+
+	if c.Urgency != "" && !c.Urgency.isValid() {
+		return nil, fmt.Errorf("webpush: invalid %vURGENCY: %q", prefix, c.Urgency)
+	}
+	if c.Prefer != "" && c.Prefer != "respond-async" {
+		return nil, fmt.Errorf("webpush: invalid %vPREFER: %q", prefix, c.Prefer)
+	}
+	if recordSize := env("RECORD_SIZE"); recordSize != "" {
+		if c.RecordSize, err = strconv.Atoi(recordSize); err != nil {
+			return nil, fmt.Errorf("webpush: invalid %vRECORD_SIZE: %w", prefix, err)
+		}
+		if c.RecordSize <= minOverhead {
+			return nil, fmt.Errorf("webpush: invalid %vRECORD_SIZE: %v is too small", prefix, c.RecordSize)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,61 @@
+package webpush
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func setValidEnv(t *testing.T) {
+	t.Setenv("WEBPUSH_VAPID_KEY", "Npnu7ulDI0A5nvDXgrEreznX809sYVuIqEh7AXG2oOk")
+	t.Setenv("WEBPUSH_SUBSCRIBER", validHTTPSSubscriber)
+	t.Setenv("WEBPUSH_TTL", "1h30m")
+}
+
+func TestClientFromEnv(t *testing.T) {
+	setValidEnv(t)
+	t.Setenv("WEBPUSH_TOPIC", "news")
+	t.Setenv("WEBPUSH_URGENCY", "high")
+	t.Setenv("WEBPUSH_RECORD_SIZE", "2048")
+	t.Setenv("WEBPUSH_USER_AGENT", "my-server")
+	t.Setenv("WEBPUSH_PREFER", "respond-async")
+	c, err := ClientFromEnv("WEBPUSH_")
+	ensure.Nil(t, err)
+	ensure.True(t, c.VAPIDKey.Equal(validVapidKey))
+	ensure.DeepEqual(t, c.Subscriber, validHTTPSSubscriber)
+	ensure.DeepEqual(t, c.TTL, 90*time.Minute)
+	ensure.DeepEqual(t, c.Topic, "news")
+	ensure.DeepEqual(t, c.Urgency, UrgencyHigh)
+	ensure.DeepEqual(t, c.RecordSize, 2048)
+	ensure.DeepEqual(t, c.UserAgent, "my-server")
+	ensure.DeepEqual(t, c.Prefer, "respond-async")
+	ensure.True(t, c.Client == nil)
+}
+
+func TestClientFromEnvErrors(t *testing.T) {
+	cases := []struct {
+		name, value string
+		err         string
+	}{
+		{"WEBPUSH_VAPID_KEY", "", "missing WEBPUSH_VAPID_KEY"},
+		{"WEBPUSH_VAPID_KEY", "not-a-key", "invalid WEBPUSH_VAPID_KEY"},
+		{"WEBPUSH_SUBSCRIBER", "admin@example.com", "invalid WEBPUSH_SUBSCRIBER"},
+		{"WEBPUSH_TTL", "", "missing WEBPUSH_TTL"},
+		{"WEBPUSH_TTL", "an hour", "invalid WEBPUSH_TTL"},
+		{"WEBPUSH_TTL", "-1s", "invalid WEBPUSH_TTL"},
+		{"WEBPUSH_URGENCY", "urgent", "invalid WEBPUSH_URGENCY"},
+		{"WEBPUSH_PREFER", "sync", "invalid WEBPUSH_PREFER"},
+		{"WEBPUSH_RECORD_SIZE", "big", "invalid WEBPUSH_RECORD_SIZE"},
+		{"WEBPUSH_RECORD_SIZE", "64", "invalid WEBPUSH_RECORD_SIZE"},
+	}
+	for _, c := range cases {
+		t.Run(c.name+"="+c.value, func(t *testing.T) {
+			setValidEnv(t)
+			t.Setenv(c.name, c.value)
+			_, err := ClientFromEnv("WEBPUSH_")
+			ensure.Err(t, err, regexp.MustCompile(c.err))
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package webpush
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// EventCategory classifies the outcome of a request to an Endpoint.
+type EventCategory string
+
+const (
+	EventSent          EventCategory = "sent"           // The Push Service accepted the message.
+	EventGone          EventCategory = "gone"           // The Subscription is permanently gone.
+	EventRateLimited   EventCategory = "rate-limited"   // The response matches ErrRateLimited.
+	EventVAPIDRejected EventCategory = "vapid-rejected" // The response matches ErrVAPIDRejected.
+	EventFailed        EventCategory = "failed"         // Other error responses.
+	EventTransport     EventCategory = "transport"      // The request could not be made.
+)
+
+// Event describes a completed request to an Endpoint, as sent to the Client
+// Events channel.
+type Event struct {
+	EndpointHost string
+	StatusCode   int // Zero if the request could not be made.
+	Duration     time.Duration
+	Attempt      int // 1 for the first attempt, 2 for a ResyncClockOn401 retry.
+	Category     EventCategory
+	TraceID      string // From the Client TraceIDFromContext, if set.
+}
+
+// emit sends the Event for the completed request to the Events channel, if
+// one is configured, without blocking.
+func (c *Client) emit(req *http.Request, endpoint string, start time.Time, res *http.Response, body []byte, err error) {
+	if c.Events == nil {
+		return
+	}
+	e := Event{
+		EndpointHost: "<unknown-endpoint>",
+		Duration:     time.Since(start),
+		Attempt:      c.attempt + 1,
+	}
+	if c.TraceIDFromContext != nil {
+		e.TraceID = c.TraceIDFromContext(req.Context())
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		e.EndpointHost = u.Hostname()
+	}
+	if res != nil {
+		e.StatusCode = res.StatusCode
+	}
+	switch {
+	case err != nil:
+		e.Category = EventTransport
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		e.Category = EventSent
+	default:
+		pushErr := newError(endpoint, res, body)
+		switch {
+		case pushErr.Permanent:
+			e.Category = EventGone
+		case errors.Is(pushErr, ErrRateLimited):
+			e.Category = EventRateLimited
+		case errors.Is(pushErr, ErrVAPIDRejected):
+			e.Category = EventVAPIDRejected
+		default:
+			e.Category = EventFailed
+		}
+	}
+	select {
+	case c.Events <- e:
+	default:
+		if c.EventsDropped != nil {
+			c.EventsDropped.Add(1)
+		}
+	}
+}
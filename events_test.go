@@ -0,0 +1,139 @@
+package webpush
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func TestEvents(t *testing.T) {
+	pinTime(t, goldTime)
+	statuses := []int{http.StatusCreated, http.StatusGone, http.StatusTooManyRequests, http.StatusForbidden, http.StatusInternalServerError, 0}
+	var i int
+	events := make(chan Event, 10)
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				status := statuses[i]
+				i++
+				if status == 0 {
+					return nil, errors.New("connection reset")
+				}
+				return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(""))}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Events:     events,
+	}
+	ctx := context.Background()
+	for range statuses {
+		_ = client.Send(ctx, []byte("test"), &validSubscription)
+	}
+	close(events)
+	var categories []EventCategory
+	for e := range events {
+		ensure.DeepEqual(t, e.EndpointHost, "the.push.server")
+		ensure.DeepEqual(t, e.Attempt, 1)
+		ensure.DeepEqual(t, e.StatusCode, statuses[len(categories)])
+		categories = append(categories, e.Category)
+	}
+	ensure.DeepEqual(t, categories, []EventCategory{
+		EventSent, EventGone, EventRateLimited, EventVAPIDRejected, EventFailed, EventTransport,
+	})
+}
+
+func TestEventsResyncAttempt(t *testing.T) {
+	pinTime(t, goldTime)
+	var requests int
+	events := make(chan Event, 2)
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				requests++
+				if requests == 1 {
+					return &http.Response{
+						StatusCode: http.StatusUnauthorized,
+						Header:     http.Header{"Date": {goldTime.Add(time.Hour).Format(http.TimeFormat)}},
+						Body:       io.NopCloser(strings.NewReader("")),
+					}, nil
+				}
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:         validVapidKey,
+		Subscriber:       validHTTPSSubscriber,
+		TTL:              time.Hour,
+		ResyncClockOn401: true,
+		Events:           events,
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &validSubscription))
+	first, second := <-events, <-events
+	ensure.DeepEqual(t, [2]int{first.Attempt, second.Attempt}, [2]int{1, 2})
+	ensure.DeepEqual(t, first.Category, EventVAPIDRejected)
+	ensure.DeepEqual(t, second.Category, EventSent)
+}
+
+func TestEventsDropped(t *testing.T) {
+	events := make(chan Event, 1)
+	var dropped atomic.Int64
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:      validVapidKey,
+		Subscriber:    validHTTPSSubscriber,
+		TTL:           time.Hour,
+		Events:        events,
+		EventsDropped: &dropped,
+	}
+	ctx := context.Background()
+	for range 3 {
+		ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	}
+	ensure.Nil(t, client.SendAndForget(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(events), 1)
+	ensure.DeepEqual(t, dropped.Load(), int64(3))
+}
+
+type traceIDKey struct{}
+
+func TestEventsTraceID(t *testing.T) {
+	var header string
+	events := make(chan Event, 2)
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				header = r.Header.Get("X-Request-ID")
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Events:     events,
+		TraceIDFromContext: func(ctx context.Context) string {
+			id, _ := ctx.Value(traceIDKey{}).(string)
+			return id
+		},
+	}
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "req-42")
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, (<-events).TraceID, "req-42")
+	ensure.DeepEqual(t, header, "")
+
+	client.TraceHeader = "X-Request-ID"
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, (<-events).TraceID, "req-42")
+	ensure.DeepEqual(t, header, "req-42")
+}
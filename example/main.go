@@ -53,6 +53,14 @@ func run() error {
 	}
 	vapidKeyPublicB64 := base64.RawURLEncoding.EncodeToString(vapidKeyPublicBytes)
 
+	// the client is created once and shared, reusing pooled connections
+	client := &webpush.Client{
+		Client:     webpush.NewHTTPClient(),
+		VAPIDKey:   vapidKey,
+		Subscriber: "https://github.com/daaku/webpush",
+		TTL:        time.Hour,
+	}
+
 	var mux http.ServeMux
 
 	// serve some static files
@@ -94,12 +102,6 @@ func run() error {
 			msg, _ := json.Marshal(map[string]any{
 				"title": "Test push from WebPush Example",
 			})
-			client := &webpush.Client{
-				Client:     http.DefaultClient,
-				VAPIDKey:   vapidKey,
-				Subscriber: "https://github.com/daaku/webpush",
-				TTL:        time.Hour,
-			}
 			err := client.Send(context.Background(), msg, &sub)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "webpush.Send error:", err)
@@ -0,0 +1,27 @@
+package webpush
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// NewHTTPClient returns a http.Client suitable for the Client, using a clone of
+// http.DefaultTransport that requires TLS 1.2 or later. Go already defaults to
+// TLS 1.2, but this makes the requirement explicit regardless of the GODEBUG
+// settings of the program. Redirects are not followed, and are returned as an
+// Error matching ErrRedirect. Each call creates a new connection pool, so the
+// returned client should be created once and shared rather than created per
+// Send.
+func NewHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.MinVersion = tls.VersionTLS12
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
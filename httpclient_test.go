@@ -0,0 +1,87 @@
+package webpush
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func newTLSServer(t *testing.T, maxVersion uint16) (*httptest.Server, *x509.CertPool) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: maxVersion}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	return srv, roots
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	ensure.DeepEqual(t, NewHTTPClient().Transport.(*http.Transport).TLSClientConfig.MinVersion, uint16(tls.VersionTLS12))
+
+	for _, c := range []struct {
+		maxVersion uint16
+		err        bool
+	}{
+		{tls.VersionTLS10, true},
+		{tls.VersionTLS11, true},
+		{tls.VersionTLS12, false},
+		{tls.VersionTLS13, false},
+	} {
+		srv, roots := newTLSServer(t, c.maxVersion)
+		client := NewHTTPClient()
+		t.Cleanup(client.CloseIdleConnections)
+		client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+		res, err := client.Get(srv.URL)
+		if c.err {
+			ensure.Err(t, err, regexp.MustCompile("protocol version"))
+			continue
+		}
+		ensure.Nil(t, err)
+		ensure.Nil(t, res.Body.Close())
+		ensure.DeepEqual(t, res.StatusCode, http.StatusCreated)
+	}
+}
+
+func TestNewHTTPClientRedirect(t *testing.T) {
+	var followed bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			followed = true
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		http.Redirect(w, r, "/moved", http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(srv.Close)
+	httpClient := NewHTTPClient()
+	t.Cleanup(httpClient.CloseIdleConnections)
+	client := &Client{
+		Client:     httpClient,
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	err := client.Send(context.Background(), []byte("test"), &Subscription{
+		Endpoint: srv.URL + "/push",
+		Keys:     validSubscription.Keys,
+	})
+	ensure.True(t, errors.Is(err, ErrRedirect), err)
+	pushErr, ok := errors.AsType[*Error](err)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, pushErr.Location, "/moved")
+	ensure.False(t, followed)
+}
@@ -0,0 +1,108 @@
+package webpush
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// CryptoKey is a single comma separated key of a Crypto-Key header.
+type CryptoKey struct {
+	KeyID  string            // Optional "keyid" label of the key.
+	Params map[string][]byte // Decoded parameters by lowercase name, such as "dh".
+}
+
+// ParseCryptoKeyHeader parses the Crypto-Key header used by the legacy aesgcm
+// encoding, returning each comma separated key in order. Each key has
+// semicolon separated parameters, whose decoded values are included by their
+// lowercase name, for example "dh" and "p256ecdsa". The "keyid" parameter is a
+// label rather than a key, and is returned as the KeyID.
+func ParseCryptoKeyHeader(header string) ([]CryptoKey, error) {
+	var keys []CryptoKey
+	err := parseLegacyParams(header, func(element int, name, value string) error {
+		if element == len(keys) {
+			keys = append(keys, CryptoKey{Params: map[string][]byte{}})
+		}
+		key := &keys[element]
+		if name == "keyid" {
+			key.KeyID = value
+			return nil
+		}
+		if _, ok := key.Params[name]; ok {
+			return fmt.Errorf("webpush: duplicate crypto-key parameter %q", name)
+		}
+		b, err := decodeLegacyValue(value)
+		if err != nil {
+			return fmt.Errorf("webpush: invalid crypto-key parameter %q: %w", name, err)
+		}
+		key.Params[name] = b
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ParseEncryptionHeader parses the Encryption header used by the legacy aesgcm
+// encoding, returning the decoded 16 byte salt of the first key. Other
+// parameters such as "keyid" and "rs" are ignored.
+func ParseEncryptionHeader(header string) (salt []byte, err error) {
+	err = parseLegacyParams(header, func(element int, name, value string) error {
+		if name != "salt" || salt != nil {
+			return nil
+		}
+		b, err := decodeLegacyValue(value)
+		if err != nil {
+			return fmt.Errorf("webpush: invalid encryption salt: %w", err)
+		}
+		if len(b) != 16 {
+			return fmt.Errorf("webpush: invalid encryption salt length of %v", len(b))
+		}
+		salt = b
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if salt == nil {
+		return nil, fmt.Errorf("webpush: missing encryption salt in %q", header)
+	}
+	return salt, nil
+}
+
+// parseLegacyParams calls each with the index of the comma separated element,
+// and the lowercase name and value of every semicolon separated name=value
+// parameter in it. Empty elements are skipped.
+func parseLegacyParams(header string, each func(element int, name, value string) error) error {
+	v := header
+	element := 0
+	started := false
+	for {
+		trimmed := strings.TrimLeft(v, " \t,;")
+		if started && strings.Contains(v[:len(v)-len(trimmed)], ",") {
+			element++
+			started = false
+		}
+		v = trimmed
+		if v == "" {
+			return nil
+		}
+		i := strings.IndexAny(v, "=;,")
+		if i < 0 || v[i] != '=' {
+			return fmt.Errorf("webpush: invalid header parameter in %q", header)
+		}
+		name := strings.ToLower(strings.TrimSpace(v[:i]))
+		var value string
+		value, v = linkParamValue(strings.TrimLeft(v[i+1:], " \t"))
+		if err := each(element, name, value); err != nil {
+			return err
+		}
+		started = true
+	}
+}
+
+// decodeLegacyValue decodes the base64url value, which may be padded.
+func decodeLegacyValue(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
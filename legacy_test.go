@@ -0,0 +1,102 @@
+package webpush
+
+import (
+	"encoding/base64"
+	"regexp"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestParseCryptoKeyHeader(t *testing.T) {
+	dh := rfc8291Subscription.Keys.P256dh
+	p256ecdsa := must(vapidPublicKey(validVapidKey))
+	dhBytes := must(base64.RawURLEncoding.DecodeString(dh))
+	p256ecdsaBytes := must(base64.RawURLEncoding.DecodeString(p256ecdsa))
+	cases := []struct {
+		header   string
+		expected []CryptoKey
+	}{
+		{
+			"dh=" + dh + ";p256ecdsa=" + p256ecdsa,
+			[]CryptoKey{{Params: map[string][]byte{"dh": dhBytes, "p256ecdsa": p256ecdsaBytes}}},
+		},
+		{
+			"dh=" + dh + "=; P256ECDSA=" + p256ecdsa + "=",
+			[]CryptoKey{{Params: map[string][]byte{"dh": dhBytes, "p256ecdsa": p256ecdsaBytes}}},
+		},
+		{
+			"dh=" + dh + "," + "p256ecdsa=" + p256ecdsa,
+			[]CryptoKey{
+				{Params: map[string][]byte{"dh": dhBytes}},
+				{Params: map[string][]byte{"p256ecdsa": p256ecdsaBytes}},
+			},
+		},
+		{
+			`keyid="p256dh";dh="` + dh + `", p256ecdsa="` + p256ecdsa + `"`,
+			[]CryptoKey{
+				{KeyID: "p256dh", Params: map[string][]byte{"dh": dhBytes}},
+				{Params: map[string][]byte{"p256ecdsa": p256ecdsaBytes}},
+			},
+		},
+		{
+			`keyid=a;dh=` + dh + `,, keyid=b;dh=` + p256ecdsa,
+			[]CryptoKey{
+				{KeyID: "a", Params: map[string][]byte{"dh": dhBytes}},
+				{KeyID: "b", Params: map[string][]byte{"dh": p256ecdsaBytes}},
+			},
+		},
+	}
+	for _, c := range cases {
+		keys, err := ParseCryptoKeyHeader(c.header)
+		ensure.Nil(t, err, c.header)
+		ensure.DeepEqual(t, keys, c.expected, c.header)
+	}
+}
+
+func TestParseCryptoKeyHeaderErrors(t *testing.T) {
+	cases := []struct {
+		header string
+		err    string
+	}{
+		{"dh=AAAA;dh=AAAA", `duplicate crypto-key parameter "dh"`},
+		{"dh=not*base64", `invalid crypto-key parameter "dh"`},
+		{"dh", "invalid header parameter"},
+		{`dh="AAAA"junk`, "invalid header parameter"},
+	}
+	for _, c := range cases {
+		_, err := ParseCryptoKeyHeader(c.header)
+		ensure.Err(t, err, regexp.MustCompile(c.err))
+	}
+}
+
+func TestParseEncryptionHeader(t *testing.T) {
+	expected := must(base64.RawURLEncoding.DecodeString(rfc8291Salt))
+	headers := []string{
+		"salt=" + rfc8291Salt,
+		`keyid="p256dh";salt="` + rfc8291Salt + `"; rs=4096`,
+		"rs=4096;salt=" + rfc8291Salt + "==, salt=AAAAAAAAAAAAAAAAAAAAAA",
+	}
+	for _, h := range headers {
+		salt, err := ParseEncryptionHeader(h)
+		ensure.Nil(t, err, h)
+		ensure.DeepEqual(t, salt, expected, h)
+	}
+}
+
+func TestParseEncryptionHeaderErrors(t *testing.T) {
+	cases := []struct {
+		header string
+		err    string
+	}{
+		{"rs=4096", "missing encryption salt"},
+		{"", "missing encryption salt"},
+		{"salt=AAAA", "invalid encryption salt length of 3"},
+		{"salt=not*base64", "invalid encryption salt"},
+		{"salt", "invalid header parameter"},
+	}
+	for _, c := range cases {
+		_, err := ParseEncryptionHeader(c.header)
+		ensure.Err(t, err, regexp.MustCompile(c.err))
+	}
+}
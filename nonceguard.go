@@ -0,0 +1,64 @@
+package webpush
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+)
+
+const defaultNonceWindowSize = 1 << 16
+
+// ErrNonceReuse is returned by NonceWindow when a content encryption key and
+// nonce pair is seen again, which would indicate a catastrophic bug.
+var ErrNonceReuse = errors.New("webpush: content encryption key and nonce reused")
+
+// NonceGuard is consulted with the derived content encryption key and nonce
+// of every message before it is encrypted. Returning an error aborts the Send.
+// It is a defense-in-depth measure for high assurance deployments.
+type NonceGuard interface {
+	Check(contentEncryptionKey, nonce []byte) error
+}
+
+// NonceWindow is a NonceGuard that remembers a hash of the most recent pairs,
+// returning ErrNonceReuse if one is seen again. The zero value is ready to
+// use, and it is safe for concurrent use.
+type NonceWindow struct {
+	Size int // Optional number of pairs to remember, defaults to 65536.
+
+	mu     sync.Mutex
+	seen   map[[sha256.Size]byte]struct{}
+	recent [][sha256.Size]byte
+	next   int
+}
+
+// Check implements NonceGuard.
+func (w *NonceWindow) Check(contentEncryptionKey, nonce []byte) error {
+	h := sha256.New()
+	h.Write(contentEncryptionKey)
+	h.Write(nonce)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.seen[sum]; ok {
+		return ErrNonceReuse
+	}
+	if w.seen == nil {
+		size := w.Size
+		if size <= 0 {
+			size = defaultNonceWindowSize
+		}
+		w.seen = make(map[[sha256.Size]byte]struct{}, size)
+		w.recent = make([][sha256.Size]byte, 0, size)
+	}
+	if len(w.recent) < cap(w.recent) {
+		w.recent = append(w.recent, sum)
+	} else {
+		delete(w.seen, w.recent[w.next])
+		w.recent[w.next] = sum
+		w.next = (w.next + 1) % len(w.recent)
+	}
+	w.seen[sum] = struct{}{}
+	return nil
+}
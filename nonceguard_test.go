@@ -0,0 +1,55 @@
+package webpush
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func TestNonceWindowSend(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		NonceGuard: &NonceWindow{},
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+
+	// force reuse with a fixed salt and application server key
+	salt := must(base64.RawURLEncoding.DecodeString(rfc8291Salt))
+	pinSalt(t, slices.Concat(salt, salt))
+	appServerKey := must(ecdh.P256().NewPrivateKey(
+		must(base64.RawURLEncoding.DecodeString(rfc8291AppServerPrivateKey))))
+	client.ECDH = func(userAgentPublicKey *ecdh.PublicKey) ([]byte, []byte, error) {
+		sharedSecret, err := appServerKey.ECDH(userAgentPublicKey)
+		return sharedSecret, appServerKey.PublicKey().Bytes(), err
+	}
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	err := client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, ErrNonceReuse), err)
+}
+
+func TestNonceWindowEvicts(t *testing.T) {
+	w := &NonceWindow{Size: 2}
+	key := make([]byte, 16)
+	for _, nonce := range []string{"a", "b", "c"} {
+		ensure.Nil(t, w.Check(key, []byte(nonce)))
+	}
+	ensure.True(t, errors.Is(w.Check(key, []byte("c")), ErrNonceReuse))
+	// evicted as the oldest
+	ensure.Nil(t, w.Check(key, []byte("a")))
+}
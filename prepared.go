@@ -0,0 +1,102 @@
+package webpush
+
+import (
+	"context"
+	"crypto/ecdh"
+	"fmt"
+)
+
+// PreparedSubscription holds a Subscription along with its decoded keys, which
+// avoids decoding them on every Send when pushing to the same Subscription
+// repeatedly. The application server key and salt are still fresh for every
+// message. Use PrepareSubscription to create one, after which it is safe for
+// concurrent use.
+type PreparedSubscription struct {
+	Subscription *Subscription
+
+	authSecret              []byte
+	userAgentPublicKeyBytes []byte
+	userAgentPublicKey      *ecdh.PublicKey
+}
+
+// PrepareSubscription decodes the Subscription keys. The Subscription must
+// not be modified afterwards.
+func PrepareSubscription(s *Subscription) (*PreparedSubscription, error) {
+	if s.Endpoint == "" || s.Keys.Auth == "" || s.Keys.P256dh == "" {
+		return nil, fmt.Errorf(
+			"webpush: invalid subscription, missing endpoint or keys")
+	}
+	p := &PreparedSubscription{Subscription: s}
+	if err := p.decode(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// decode decodes the keys, unless they have already been decoded.
+func (p *PreparedSubscription) decode() error {
+	if p.userAgentPublicKey != nil {
+		return nil
+	}
+	authSecret, err := b64Decode(p.Subscription.Keys.Auth)
+	if err != nil {
+		return fmt.Errorf("webpush: invalid encoded auth in key: %w", err)
+	}
+	userAgentPublicKeyBytes, err := b64Decode(p.Subscription.Keys.P256dh)
+	if err != nil {
+		return fmt.Errorf("webpush: invalid encoded public key: %w", err)
+	}
+	userAgentPublicKey, err := ecdh.P256().NewPublicKey(userAgentPublicKeyBytes)
+	if err != nil {
+		return fmt.Errorf("webpush: invalid user agent public key: %w", err)
+	}
+	p.authSecret = authSecret
+	p.userAgentPublicKeyBytes = userAgentPublicKeyBytes
+	p.userAgentPublicKey = userAgentPublicKey
+	return nil
+}
+
+// SendPrepared is Send for a PreparedSubscription.
+func (c *Client) SendPrepared(ctx context.Context, message []byte, p *PreparedSubscription, opts ...SendOption) error {
+	_, err := c.withOptions(opts).send(ctx, message, p, nil)
+	return err
+}
+
+// Prepared is a Client and Subscription pair that has been validated once,
+// for sending many messages to the same Subscription. It is safe for
+// concurrent use.
+type Prepared struct {
+	client       *Client
+	subscription *PreparedSubscription
+}
+
+// Prepare validates the Client and Subscription, decodes the Subscription
+// keys, and ensures VAPID tokens are cached, using a new TokenCache if the
+// Client does not have one. The options are applied once, and the Client must
+// not be modified afterwards.
+func (c *Client) Prepare(s *Subscription, opts ...SendOption) (*Prepared, error) {
+	client := *c
+	for _, o := range opts {
+		o(&client)
+	}
+	if err := client.validate(); err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	p, err := PrepareSubscription(s)
+	if err != nil {
+		return nil, err
+	}
+	if client.TokenCache == nil {
+		client.TokenCache = &TokenCache{}
+	}
+	return &Prepared{client: &client, subscription: p}, nil
+}
+
+// Send sends the message to the prepared Subscription.
+func (p *Prepared) Send(ctx context.Context, message []byte) error {
+	_, err := p.client.send(ctx, message, p.subscription, nil)
+	return err
+}
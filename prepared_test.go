@@ -0,0 +1,147 @@
+package webpush
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func newPreparedClient(records *[][]byte) *Client {
+	return &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				if records != nil {
+					body, err := io.ReadAll(r.Body)
+					if err != nil {
+						return nil, err
+					}
+					*records = append(*records, body)
+				}
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		TokenCache: &TokenCache{},
+	}
+}
+
+func TestSendPrepared(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	var records [][]byte
+	client := newPreparedClient(&records)
+	p, err := PrepareSubscription(&rfc8291Subscription)
+	ensure.Nil(t, err)
+	ctx := context.Background()
+	ensure.Nil(t, client.SendPrepared(ctx, []byte("first"), p))
+	ensure.Nil(t, client.SendPrepared(ctx, []byte("second"), p))
+
+	ensure.DeepEqual(t, string(must(Decrypt(records[0], privateKey, authSecret))), "first")
+	ensure.DeepEqual(t, string(must(Decrypt(records[1], privateKey, authSecret))), "second")
+	// application server public key
+	ensure.NotDeepEqual(t, records[0][21:headerLen], records[1][21:headerLen])
+}
+
+func TestPrepareSubscriptionErrors(t *testing.T) {
+	_, err := PrepareSubscription(&Subscription{})
+	ensure.Err(t, err, regexp.MustCompile("missing endpoint or keys"))
+	s := validSubscription
+	s.Keys.P256dh = "AAAA"
+	_, err = PrepareSubscription(&s)
+	ensure.Err(t, err, regexp.MustCompile("invalid user agent public key"))
+}
+
+func TestPrepared(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	var records [][]byte
+	client := newPreparedClient(&records)
+	client.TokenCache = nil
+	var signed int
+	client.OnTokenSigned = func(string, time.Time) { signed++ }
+	p, err := client.Prepare(&rfc8291Subscription, WithTopic("a-topic"))
+	ensure.Nil(t, err)
+	ctx := context.Background()
+	ensure.Nil(t, p.Send(ctx, []byte("first")))
+	ensure.Nil(t, p.Send(ctx, []byte("second")))
+	ensure.DeepEqual(t, string(must(Decrypt(records[1], privateKey, authSecret))), "second")
+	ensure.DeepEqual(t, signed, 1)
+	ensure.True(t, client.TokenCache == nil)
+}
+
+func TestPrepareErrors(t *testing.T) {
+	cases := []struct {
+		label  string
+		client *Client
+		sub    *Subscription
+		err    string
+	}{
+		{"http client", &Client{}, &validSubscription, "missing http client"},
+		{"vapid key", &Client{Client: http.DefaultClient}, &validSubscription, "missing vapid key"},
+		{
+			"subscriber",
+			&Client{Client: http.DefaultClient, VAPIDKey: validVapidKey, Subscriber: "admin"},
+			&validSubscription,
+			"invalid subscriber",
+		},
+		{
+			"subscription",
+			&Client{Client: http.DefaultClient, VAPIDKey: validVapidKey, Subscriber: validHTTPSSubscriber},
+			&Subscription{Endpoint: "http://the.push.server/"},
+			"endpoint is not https",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			_, err := c.client.Prepare(c.sub)
+			ensure.Err(t, err, regexp.MustCompile(c.err))
+		})
+	}
+}
+
+func BenchmarkSendSubscription(b *testing.B) {
+	b.ReportAllocs()
+	client := newPreparedClient(nil)
+	ctx := context.Background()
+	for b.Loop() {
+		if err := client.Send(ctx, []byte("test"), &validSubscription); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendPreparedSubscription(b *testing.B) {
+	b.ReportAllocs()
+	client := newPreparedClient(nil)
+	p, err := PrepareSubscription(&validSubscription)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	for b.Loop() {
+		if err := client.SendPrepared(ctx, []byte("test"), p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPreparedSend(b *testing.B) {
+	b.ReportAllocs()
+	client := newPreparedClient(nil)
+	client.TokenCache = nil
+	p, err := client.Prepare(&validSubscription)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	for b.Loop() {
+		if err := p.Send(ctx, []byte("test")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
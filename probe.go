@@ -0,0 +1,152 @@
+package webpush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Probe checks connectivity and VAPID authentication against a Push Service
+// origin, such as "https://fcm.googleapis.com", without a Subscription. It
+// makes a HEAD request to the origin with the Authorization header Send would
+// use. Network errors are returned as is, while a 401, 403 or 5xx response is
+// returned as an Error. Other responses, including 404 and 405, indicate the
+// origin was reachable and the VAPID key was not rejected.
+func (c *Client) Probe(ctx context.Context, origin string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin, nil)
+	if err != nil {
+		return fmt.Errorf("webpush: invalid origin %q: %w", origin, err)
+	}
+	resolved := c.ResolveFor(&Subscription{Endpoint: origin})
+	auth, err := c.authHeader(origin, resolved.VAPIDExpiration)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("User-Agent", resolved.UserAgent)
+
+	res, body, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	switch {
+	case res.StatusCode == http.StatusUnauthorized,
+		res.StatusCode == http.StatusForbidden,
+		res.StatusCode >= 500:
+		return newError(origin, res, body)
+	}
+	return nil
+}
+
+// Warm Probes each of the origins concurrently, establishing pooled
+// connections in the http.Client ahead of a large number of Sends. The
+// errors from all failed Probes are joined.
+func (c *Client) Warm(ctx context.Context, origins []string) error {
+	origins = slices.Compact(slices.Sorted(slices.Values(origins)))
+	return errors.Join(c.probeAll(ctx, origins)...)
+}
+
+// probeAll Probes the origins with at most 16 in flight, as the origins may
+// come from untrusted input, returning the error for each.
+func (c *Client) probeAll(ctx context.Context, origins []string) []error {
+	errs := make([]error, len(origins))
+	slots := make(chan struct{}, defaultConcurrency)
+	var wg sync.WaitGroup
+	for i, o := range origins {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+			errs[i] = c.Probe(ctx, o)
+		})
+	}
+	wg.Wait()
+	return errs
+}
+
+// ClockSkew estimates the difference between the Push Service clock and the
+// local clock, using the Date header from a HEAD request to the origin. A
+// positive value means the Push Service clock is ahead. The Date header has a
+// resolution of one second. Large skews can cause VAPID tokens to be rejected.
+func (c *Client) ClockSkew(ctx context.Context, origin string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin, nil)
+	if err != nil {
+		return 0, fmt.Errorf("webpush: invalid origin %q: %w", origin, err)
+	}
+	req.Header.Set("User-Agent", c.Resolve().UserAgent)
+	res, _, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("webpush: invalid date header from %q: %w", origin, err)
+	}
+	return date.Sub(timeNow().Truncate(time.Second)), nil
+}
+
+// PreflightReport is the outcome of Preflight.
+type PreflightReport struct {
+	Valid   int // Subscriptions that pass Validate.
+	Invalid int // Subscriptions that fail Validate.
+
+	// Origins is the Probe result for each origin of the valid Subscriptions,
+	// nil if the origin was reachable and the VAPID key was not rejected.
+	Origins map[string]error
+}
+
+// Reachable returns the number of origins that were reachable.
+func (r *PreflightReport) Reachable() int {
+	var n int
+	for _, err := range r.Origins {
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Ready reports if there is at least one valid Subscription at a reachable
+// origin.
+func (r *PreflightReport) Ready() bool {
+	return r.Reachable() > 0
+}
+
+// Preflight checks a campaign is ready to be sent, as a gate before a large
+// broadcast. An error is returned if the Client is missing a required field or
+// has an invalid Subscriber, or if the vapidPublicKey does not match the
+// VAPIDKey, which is useful to detect configuration drift. The vapidPublicKey
+// is optional. Otherwise the returned report includes the number of valid and
+// invalid Subscriptions, and the result of Probing each origin of the valid
+// ones, with at most 16 Probes in flight.
+func (c *Client) Preflight(ctx context.Context, subs []*Subscription, vapidPublicKey string) (*PreflightReport, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if vapidPublicKey != "" {
+		matches, err := VAPIDKeyMatches(c.VAPIDKey, vapidPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("webpush: invalid vapid public key: %w", err)
+		}
+		if !matches {
+			return nil, errors.New("webpush: vapid public key does not match the vapid key")
+		}
+	}
+
+	valid, invalid := PartitionValid(subs)
+	report := &PreflightReport{
+		Valid:   len(valid),
+		Invalid: len(invalid),
+		Origins: make(map[string]error),
+	}
+	origins := slices.Sorted(maps.Keys(GroupByOrigin(valid)))
+	errs := c.probeAll(ctx, origins)
+	for i, o := range origins {
+		report.Origins[o] = errs[i]
+	}
+	return report, nil
+}
@@ -0,0 +1,209 @@
+package webpush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func newProbeClient(t testing.TB, status int) *Client {
+	return &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ensure.DeepEqual(t, r.Method, http.MethodHead)
+				ensure.DeepEqual(t, r.URL.String(), validSubscriptionEndpointOrigin)
+				ensure.DeepEqual(t, authClaims(t, r)["aud"], validSubscriptionEndpointOrigin)
+				return &http.Response{StatusCode: status}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+	}
+}
+
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+	ensure.Nil(t, newProbeClient(t, http.StatusOK).Probe(ctx, validSubscriptionEndpointOrigin))
+	ensure.Nil(t, newProbeClient(t, http.StatusMethodNotAllowed).Probe(ctx, validSubscriptionEndpointOrigin))
+
+	err := newProbeClient(t, http.StatusUnauthorized).Probe(ctx, validSubscriptionEndpointOrigin)
+	ensure.True(t, errors.Is(err, ErrVAPIDRejected), err)
+
+	// probes are not pushes
+	client := newProbeClient(t, http.StatusOK)
+	client.OnDuration = func(time.Duration, int) { t.Error("unexpected OnDuration") }
+	ensure.Nil(t, client.Probe(ctx, validSubscriptionEndpointOrigin))
+}
+
+func TestProbeNetworkError(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+	}
+	err := client.Probe(context.Background(), validSubscriptionEndpointOrigin)
+	ensure.Err(t, err, regexp.MustCompile("connection refused"))
+	_, ok := errors.AsType[*Error](err)
+	ensure.False(t, ok)
+}
+
+func TestWarm(t *testing.T) {
+	var mu sync.Mutex
+	var probed []string
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				probed = append(probed, r.URL.String())
+				if r.URL.Host == "down.push.server" {
+					return &http.Response{StatusCode: http.StatusServiceUnavailable}, nil
+				}
+				return &http.Response{StatusCode: http.StatusNotFound}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+	}
+	origins := []string{
+		"https://fcm.googleapis.com",
+		"https://web.push.apple.com",
+		"https://fcm.googleapis.com",
+	}
+	ensure.Nil(t, client.Warm(context.Background(), origins))
+	slices.Sort(probed)
+	ensure.DeepEqual(t, probed, []string{"https://fcm.googleapis.com", "https://web.push.apple.com"})
+
+	err := client.Warm(context.Background(), []string{"https://down.push.server"})
+	ensure.Err(t, err, regexp.MustCompile("503"))
+}
+
+func TestClockSkew(t *testing.T) {
+	pinTime(t, goldTime)
+	date := goldTime.Add(-90 * time.Second).Format(http.TimeFormat)
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusNotFound,
+					Header:     http.Header{"Date": {date}},
+				}, nil
+			}),
+		},
+	}
+	skew, err := client.ClockSkew(context.Background(), validSubscriptionEndpointOrigin)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, skew, -90*time.Second)
+
+	date = ""
+	_, err = client.ClockSkew(context.Background(), validSubscriptionEndpointOrigin)
+	ensure.Err(t, err, regexp.MustCompile("invalid date header"))
+}
+
+func TestPreflight(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ensure.DeepEqual(t, r.Method, http.MethodHead)
+				if r.URL.Host == "down.push.server" {
+					return &http.Response{StatusCode: http.StatusServiceUnavailable}, nil
+				}
+				return &http.Response{StatusCode: http.StatusMethodNotAllowed}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+	}
+	down := validSubscription
+	down.Endpoint = "https://down.push.server/capability-url"
+	other := validSubscription
+	other.Endpoint = validSubscription.Endpoint + "/other"
+	badKeys := validSubscription
+	badKeys.Endpoint = "https://bad.push.server/capability-url"
+	badKeys.Keys.Auth = "{}"
+	subs := []*Subscription{&validSubscription, &other, &down, &badKeys, {}}
+
+	report, err := client.Preflight(context.Background(), subs, must(vapidPublicKey(validVapidKey)))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.Valid, 3)
+	ensure.DeepEqual(t, report.Invalid, 2)
+	ensure.DeepEqual(t, len(report.Origins), 2)
+	ensure.Nil(t, report.Origins[validSubscriptionEndpointOrigin])
+	pushErr, ok := errors.AsType[*Error](report.Origins["https://down.push.server"])
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, pushErr.StatusCode, http.StatusServiceUnavailable)
+	ensure.DeepEqual(t, report.Reachable(), 1)
+	ensure.True(t, report.Ready())
+
+	report, err = client.Preflight(context.Background(), []*Subscription{&down, &badKeys}, "")
+	ensure.Nil(t, err)
+	ensure.False(t, report.Ready())
+}
+
+func TestPreflightConcurrencyLimit(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, peak int
+	var filled bool
+	full := make(chan struct{})
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				mu.Lock()
+				inFlight++
+				peak = max(peak, inFlight)
+				if inFlight == defaultConcurrency && !filled {
+					filled = true
+					close(full)
+				}
+				mu.Unlock()
+				<-full
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+				return &http.Response{StatusCode: http.StatusMethodNotAllowed}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+	}
+	subs := make([]*Subscription, 40)
+	for i := range subs {
+		sub := validSubscription
+		sub.Endpoint = fmt.Sprintf("https://push%d.server/capability-url", i)
+		subs[i] = &sub
+	}
+	report, err := client.Preflight(context.Background(), subs, "")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, report.Reachable(), 40)
+	ensure.DeepEqual(t, peak, defaultConcurrency)
+}
+
+func TestPreflightErrors(t *testing.T) {
+	ctx := context.Background()
+	otherKey := must(GenerateVAPIDKey())
+	otherPublicKey := must(vapidPublicKey(must(ParseVAPIDKey(otherKey))))
+	client := &Client{Client: &http.Client{}, VAPIDKey: validVapidKey, Subscriber: validHTTPSSubscriber}
+
+	_, err := client.Preflight(ctx, nil, otherPublicKey)
+	ensure.Err(t, err, regexp.MustCompile("does not match"))
+	_, err = client.Preflight(ctx, nil, "{}")
+	ensure.Err(t, err, regexp.MustCompile("invalid vapid public key"))
+
+	client.Subscriber = "admin@example.com"
+	_, err = client.Preflight(ctx, nil, "")
+	ensure.Err(t, err, regexp.MustCompile("invalid subscriber"))
+	_, err = (&Client{Client: &http.Client{}}).Preflight(ctx, nil, "")
+	ensure.Err(t, err, regexp.MustCompile("missing vapid key"))
+}
@@ -0,0 +1,169 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"sync"
+	"time"
+)
+
+// Cached tokens are signed again once they have less than this validity left,
+// or a quarter of their lifetime for shorter lived tokens.
+const tokenRefreshAhead = time.Hour
+
+// TokenCache memoizes signed VAPID tokens per VAPID key, Subscriber and
+// origin, avoiding the cost of signing a new token for every Send. Tokens are
+// reused until they have less than an hour, or a quarter of their lifetime if
+// shorter, of validity left. Tokens are not cached for Clients with a
+// SignVAPID or VAPIDHeader, as they cannot be told apart. The zero value is
+// ready to use, and it is safe for concurrent use.
+type TokenCache struct {
+	mu      sync.Mutex
+	tokens  map[tokenCacheKey]cachedToken
+	offsets map[string]time.Duration // Learned Push Service clock offsets by origin.
+}
+
+type tokenCacheKey struct {
+	vapidKey   *ecdsa.PrivateKey
+	subscriber string
+	origin     string
+	expiration time.Time // Only set for an explicit VAPIDExpiration.
+	skew       time.Duration
+}
+
+type cachedToken struct {
+	header     string
+	expiration time.Time
+	refreshAt  time.Time
+}
+
+// get returns the cached token for the key, or signs and caches a new one.
+// The signing happens without holding the lock, so concurrent misses for the
+// same key may each sign a token.
+func (tc *TokenCache) get(key tokenCacheKey, expiration time.Time, sign func() (string, error)) (string, error) {
+	tc.mu.Lock()
+	t, ok := tc.tokens[key]
+	tc.mu.Unlock()
+	if ok && timeNow().Before(t.refreshAt) {
+		return t.header, nil
+	}
+	header, err := sign()
+	if err != nil {
+		return "", err
+	}
+
+	now := timeNow()
+	refreshAhead := min(tokenRefreshAhead, expiration.Sub(now)/4)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.tokens == nil {
+		tc.tokens = make(map[tokenCacheKey]cachedToken)
+	}
+	for k, t := range tc.tokens {
+		if !now.Before(t.refreshAt) {
+			delete(tc.tokens, k)
+		}
+	}
+	tc.tokens[key] = cachedToken{
+		header:     header,
+		expiration: expiration,
+		refreshAt:  expiration.Add(-refreshAhead),
+	}
+	return header, nil
+}
+
+// resync drops the cached tokens for the origin, and sets the offset from the
+// Push Service clock used to sign later tokens for it.
+func (tc *TokenCache) resync(origin string, offset time.Duration) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for k := range tc.tokens {
+		if k.origin == origin {
+			delete(tc.tokens, k)
+		}
+	}
+	if tc.offsets == nil {
+		tc.offsets = make(map[string]time.Duration)
+	}
+	tc.offsets[origin] = offset
+}
+
+// offset returns the offset from the Push Service clock for the origin.
+func (tc *TokenCache) offset(origin string) time.Duration {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.offsets[origin]
+}
+
+// ExpiresIn returns the remaining validity at now of the cached token for the
+// origin, such as "https://fcm.googleapis.com". If multiple VAPID keys or
+// Subscribers have been used with the origin, the longest validity is
+// returned. It returns false if there is no cached token for the origin that
+// is still valid at now.
+func (tc *TokenCache) ExpiresIn(origin string, now time.Time) (time.Duration, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	var expiration time.Time
+	for key, t := range tc.tokens {
+		if key.origin == origin && t.expiration.After(expiration) {
+			expiration = t.expiration
+		}
+	}
+	if !expiration.After(now) {
+		return 0, false
+	}
+	return expiration.Sub(now), true
+}
+
+// tokenCache returns the TokenCache if tokens can be cached for the Client.
+func (c *Client) tokenCache() *TokenCache {
+	if c.SignVAPID != nil || c.VAPIDHeader != nil {
+		return nil
+	}
+	return c.TokenCache
+}
+
+// authHeader returns the VAPID Authorization header, using the TokenCache if
+// one is configured. The expiration is relative to the local clock, and is
+// adjusted for the Push Service clock if there is a learned offset.
+func (c *Client) authHeader(endpoint string, expiration time.Time) (string, error) {
+	aud, err := origin(endpoint)
+	if err != nil {
+		return "", err
+	}
+	subscriber := c.subscriber()
+	cache := c.tokenCache()
+	var offset time.Duration
+	if cache != nil {
+		offset = cache.offset(aud)
+	}
+	sign := func() (string, error) {
+		claimed, issuedAt := expiration.Add(offset), time.Time{}
+		if c.ClockSkewTolerance > 0 {
+			claimed = claimed.Add(c.ClockSkewTolerance)
+			issuedAt = c.now().Add(offset - c.ClockSkewTolerance)
+		}
+		token, publicKey, err := makeVAPIDToken(
+			endpoint, subscriber, c.VAPIDKey, claimed, issuedAt, c.SignVAPID)
+		if err != nil {
+			return "", err
+		}
+		if c.OnTokenSigned != nil {
+			c.OnTokenSigned(aud, expiration)
+		}
+		if c.VAPIDHeader != nil {
+			return c.VAPIDHeader(token, publicKey), nil
+		}
+		return formatVAPIDHeader(token, publicKey), nil
+	}
+	if cache == nil {
+		return sign()
+	}
+	key := tokenCacheKey{
+		vapidKey:   c.VAPIDKey,
+		subscriber: subscriber,
+		origin:     aud,
+		expiration: c.VAPIDExpiration,
+		skew:       c.ClockSkewTolerance,
+	}
+	return cache.get(key, expiration, sign)
+}
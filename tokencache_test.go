@@ -0,0 +1,177 @@
+package webpush
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func newTokenCacheClient(cache *TokenCache, signed *[]string) *Client {
+	return &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		TokenCache: cache,
+		OnTokenSigned: func(origin string, expiration time.Time) {
+			*signed = append(*signed, origin)
+		},
+	}
+}
+
+func TestTokenCacheReuse(t *testing.T) {
+	pinTime(t, goldTime)
+	var signed []string
+	client := newTokenCacheClient(&TokenCache{}, &signed)
+	other := validSubscription
+	other.Endpoint = "https://other.push.server/capability-url"
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &other))
+	// the host is case insensitive
+	upper := validSubscription
+	upper.Endpoint = "https://THE.push.server/capability-url"
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &upper))
+	ensure.DeepEqual(t, signed, []string{validSubscriptionEndpointOrigin, "https://other.push.server"})
+}
+
+func TestTokenCacheRefresh(t *testing.T) {
+	pinTime(t, goldTime)
+	var signed []string
+	client := newTokenCacheClient(&TokenCache{}, &signed)
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	pinTime(t, goldTime.Add(defaultVAPIDLifetime-tokenRefreshAhead/2))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(signed), 2)
+}
+
+func TestTokenCacheDisabled(t *testing.T) {
+	var signed []string
+	client := newTokenCacheClient(nil, &signed)
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(signed), 2)
+}
+
+func TestTokenCacheExpiresIn(t *testing.T) {
+	pinTime(t, goldTime)
+	var signed []string
+	cache := &TokenCache{}
+	client := newTokenCacheClient(cache, &signed)
+	_, ok := cache.ExpiresIn(validSubscriptionEndpointOrigin, goldTime)
+	ensure.False(t, ok)
+
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &validSubscription))
+	remaining, ok := cache.ExpiresIn(validSubscriptionEndpointOrigin, goldTime)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, remaining, defaultVAPIDLifetime)
+	remaining, ok = cache.ExpiresIn(validSubscriptionEndpointOrigin, goldTime.Add(time.Hour))
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, remaining, defaultVAPIDLifetime-time.Hour)
+
+	_, ok = cache.ExpiresIn("https://other.push.server", goldTime)
+	ensure.False(t, ok)
+
+	remaining, ok = cache.ExpiresIn(validSubscriptionEndpointOrigin, goldTime.Add(defaultVAPIDLifetime+time.Second))
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, remaining, time.Duration(0))
+}
+
+func TestTokenCacheKey(t *testing.T) {
+	pinTime(t, goldTime)
+	var signed []string
+	cache := &TokenCache{}
+	client := newTokenCacheClient(cache, &signed)
+	skewed := newTokenCacheClient(cache, &signed)
+	skewed.ClockSkewTolerance = time.Minute
+	custom := newTokenCacheClient(cache, &signed)
+	custom.VAPIDHeader = func(token, publicKey string) string { return "WebPush " + token }
+	ctx := context.Background()
+	for range 2 {
+		ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+		ensure.Nil(t, skewed.Send(ctx, []byte("test"), &validSubscription))
+		ensure.Nil(t, custom.Send(ctx, []byte("test"), &validSubscription))
+	}
+	// one token each for client and skewed, custom is never cached
+	ensure.DeepEqual(t, len(signed), 4)
+}
+
+func TestTokenCacheShortLifetime(t *testing.T) {
+	pinTime(t, goldTime)
+	var signed []string
+	client := newTokenCacheClient(&TokenCache{}, &signed)
+	client.VAPIDExpiration = goldTime.Add(time.Hour)
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	pinTime(t, goldTime.Add(30*time.Minute))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(signed), 1)
+	pinTime(t, goldTime.Add(45*time.Minute))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(signed), 2)
+}
+
+func TestTokenCacheEvictsExpired(t *testing.T) {
+	pinTime(t, goldTime)
+	var signed []string
+	cache := &TokenCache{}
+	client := newTokenCacheClient(cache, &signed)
+	ctx := context.Background()
+	for i := range 5 {
+		now := goldTime.Add(time.Duration(i) * 2 * time.Hour)
+		pinTime(t, now)
+		client.VAPIDExpiration = now.Add(time.Hour)
+		ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	}
+	ensure.DeepEqual(t, len(cache.tokens), 1)
+}
+
+func TestTokenCacheSignsWithoutLock(t *testing.T) {
+	var signed []string
+	cache := &TokenCache{}
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	client := newTokenCacheClient(cache, &signed)
+	client.OnTokenSigned = func(origin string, expiration time.Time) {
+		if origin == validSubscriptionEndpointOrigin {
+			close(blocked)
+			<-release
+		}
+	}
+	ctx := context.Background()
+	done := make(chan error)
+	go func() { done <- client.Send(ctx, []byte("test"), &validSubscription) }()
+	<-blocked
+
+	// another origin can be signed while the first is still signing
+	other := validSubscription
+	other.Endpoint = "https://other.push.server/capability-url"
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &other))
+	close(release)
+	ensure.Nil(t, <-done)
+}
+
+func BenchmarkAuthHeaderTokenCache(b *testing.B) {
+	b.ReportAllocs()
+	client := &Client{
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TokenCache: &TokenCache{},
+	}
+	expiration := time.Now().Add(defaultVAPIDLifetime)
+	for b.Loop() {
+		if _, err := client.authHeader(validSubscription.Endpoint, expiration); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -21,25 +21,29 @@ package webpush
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"weak"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/hkdf"
@@ -50,12 +54,38 @@ const (
 	// Apple for example does not.
 	maxRecordSize = 4096
 
+	// salt: 16 + record size: 4 + key id length: 1 + key id: 65
 	headerLen = 86
 
+	// Uncompressed P-256 public key, used as the key id.
+	publicKeyLen = 65
+
 	// header: 86 + padding: minimum 1 + AEAD_AES_128_GCM Expansion: 16
+	// The header counts against the record size, matching the 3993 bytes of
+	// plaintext allowed by RFC 8291 section 4 for a 4096 byte body.
 	minOverhead = 103
+
+	defaultUserAgent = "daaku-webpush"
+
+	// Response bodies are only used for error messages.
+	maxResponseBody = 4096
+
+	defaultVAPIDLifetime = 12 * time.Hour
+)
+
+// Sizes of the parts of an encrypted message, for callers computing their own
+// payload budgets. The largest message that fits in a record is the record
+// size less MinOverhead.
+const (
+	HeaderLen   = headerLen   // Salt, record size, key id length and key id.
+	PaddingLen  = 1           // Minimum padding, the delimiter byte.
+	TagLen      = 16          // AEAD_AES_128_GCM authentication tag.
+	MinOverhead = minOverhead // HeaderLen + PaddingLen + TagLen.
 )
 
+// Replaced in tests to pin the clock.
+var timeNow = time.Now
+
 // Error returned by Send when the Push Endpoint returns an error.
 type Error struct {
 	StatusCode int    // HTTP StatusCode from the Endpoint.
@@ -75,6 +105,13 @@ type Error struct {
 	// Location header returned by Push Endpoint in case the subscription Endpoint
 	// needs to be updated.
 	Location string
+
+	// Code and Status are populated when the Push Endpoint returns a known JSON
+	// error shape, such as those used by Google and Mozilla. They are provider
+	// specific and will be empty otherwise, in which case only Body is
+	// available.
+	Code   int
+	Status string
 }
 
 // Error returns the error message.
@@ -82,6 +119,71 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("webpush: %s: %s", e.EndpointHost, e.Message)
 }
 
+// ErrRedirect matches an Error where the Endpoint responded with a redirect
+// that was not followed, with the new URL available as the Location.
+//
+// Note that a http.Client follows redirects by default, but drops the
+// Authorization header if the redirect leaves the original domain, and the
+// VAPID audience would not match the new origin anyway. Use NewHTTPClient, or
+// a CheckRedirect returning http.ErrUseLastResponse, to observe redirects
+// instead.
+var ErrRedirect = errors.New("webpush: redirect from push endpoint")
+
+// ErrVAPIDRejected matches an Error where the Endpoint rejected the VAPID
+// Authorization, which is usually caused by a wrong key, clock skew or an
+// expired token rather than a problem with the Subscription.
+var ErrVAPIDRejected = errors.New("webpush: vapid authorization rejected by push endpoint")
+
+// ErrRateLimited matches an Error where the Endpoint responded with 429 Too
+// Many Requests.
+var ErrRateLimited = errors.New("webpush: rate limited by push endpoint")
+
+// ErrBadVAPID, ErrBadPayload and ErrBadRequestOther match an Error where the
+// Endpoint responded with 400 Bad Request, classified using a best-guess based
+// on the message from the Push Service. ErrBadVAPID indicates a malformed JWT
+// or key, ErrBadPayload a problem with the encrypted body or its headers, and
+// ErrBadRequestOther an unknown reason. Retrying the same request will not
+// succeed for any of them.
+var (
+	ErrBadVAPID        = errors.New("webpush: bad vapid authorization")
+	ErrBadPayload      = errors.New("webpush: bad payload")
+	ErrBadRequestOther = errors.New("webpush: bad request")
+)
+
+var (
+	badVAPIDHints   = []string{"vapid", "jwt", "authorization", "providertoken", "p256ecdsa", "crypto-key"}
+	badPayloadHints = []string{"payload", "encrypt", "encoding", "salt", "padding", "ciphertext", "aes128gcm"}
+)
+
+// badRequest returns the class of a 400 Bad Request response.
+func (e *Error) badRequest() error {
+	text := strings.ToLower(e.Message + " " + string(e.Body))
+	contains := func(hint string) bool { return strings.Contains(text, hint) }
+	switch {
+	case slices.ContainsFunc(badVAPIDHints, contains):
+		return ErrBadVAPID
+	case slices.ContainsFunc(badPayloadHints, contains):
+		return ErrBadPayload
+	}
+	return ErrBadRequestOther
+}
+
+// Is supports matching the error classes defined by this package using
+// errors.Is.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrRedirect:
+		return e.StatusCode >= 300 && e.StatusCode <= 399
+	case ErrVAPIDRejected:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrBadVAPID, ErrBadPayload, ErrBadRequestOther:
+		return e.StatusCode == http.StatusBadRequest && e.badRequest() == target
+	}
+	return false
+}
+
 var openCurly = []byte("{")
 
 func newError(endpoint string, res *http.Response, body []byte) *Error {
@@ -91,21 +193,38 @@ func newError(endpoint string, res *http.Response, body []byte) *Error {
 		endpointHost = u.Hostname()
 	}
 
-	var msg string
+	var msg, status string
+	var code int
 	switch {
 	case bytes.HasPrefix(body, openCurly):
 		var j struct {
-			Message string `json:"message"` // used by Mozilla
-			Reason  string `json:"reason"`  // used by Apple
+			Code    int             `json:"code"`    // used by Mozilla
+			Error   json.RawMessage `json:"error"`   // object for Google, string for Mozilla
+			Message string          `json:"message"` // used by Mozilla
+			Reason  string          `json:"reason"`  // used by Apple
 		}
 		_ = json.Unmarshal(body, &j)
-		msg = j.Message
+		if bytes.HasPrefix(j.Error, openCurly) {
+			var g struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+				Status  string `json:"status"`
+			}
+			_ = json.Unmarshal(j.Error, &g)
+			code, msg, status = g.Code, g.Message, g.Status
+		} else {
+			code, msg = j.Code, j.Message
+			_ = json.Unmarshal(j.Error, &status)
+		}
 		if msg == "" {
 			msg = j.Reason
 		}
 	case strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain"): // used by Google
 		msg = string(bytes.TrimSpace(body))
 	}
+	if msg == "" && res.StatusCode >= 300 && res.StatusCode <= 399 {
+		msg = fmt.Sprintf("push endpoint redirected to %q", res.Header.Get("Location"))
+	}
 	if msg == "" {
 		msg = fmt.Sprintf("error from push endpoint with status=%d", res.StatusCode)
 	}
@@ -117,7 +236,128 @@ func newError(endpoint string, res *http.Response, body []byte) *Error {
 		EndpointHost: endpointHost,
 		Permanent:    res.StatusCode == 404 || res.StatusCode == 410,
 		Location:     res.Header.Get("Location"),
+		Code:         code,
+		Status:       status,
+	}
+}
+
+// parseTTL parses a TTL header value, returning nil if it is not valid.
+func parseTTL(value string) *time.Duration {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+	if err != nil || seconds < 0 {
+		return nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	return &ttl
+}
+
+const receiptRel = "urn:ietf:params:push:receipt"
+
+// linkWithRel returns the target of the first link in the Link header values
+// with the relation type, as defined by RFC 8288.
+func linkWithRel(values []string, rel string) string {
+	for _, v := range values {
+		for {
+			v = strings.TrimLeft(v, " \t,")
+			if !strings.HasPrefix(v, "<") {
+				break
+			}
+			end := strings.IndexByte(v, '>')
+			if end < 0 {
+				break
+			}
+			target := v[1:end]
+			v = v[end+1:]
+			matched := false
+			for {
+				v = strings.TrimLeft(v, " \t")
+				if !strings.HasPrefix(v, ";") {
+					break
+				}
+				v = v[1:]
+				var name, value string
+				if i := strings.IndexAny(v, "=;,"); i < 0 {
+					name, v = v, ""
+				} else {
+					name, v = v[:i], v[i:]
+				}
+				if strings.HasPrefix(v, "=") {
+					value, v = linkParamValue(strings.TrimLeft(v[1:], " \t"))
+				}
+				if strings.EqualFold(strings.TrimSpace(name), "rel") {
+					matched = matched || slices.ContainsFunc(strings.Fields(value), func(r string) bool {
+						return strings.EqualFold(r, rel)
+					})
+				}
+			}
+			if matched {
+				return target
+			}
+		}
 	}
+	return ""
+}
+
+// resolveLink resolves a link target against the URL of the request that was
+// responded to, as required by RFC 8288 section 3.1.
+func resolveLink(req *http.Request, res *http.Response, target string) string {
+	if target == "" {
+		return ""
+	}
+	base := req.URL
+	if res.Request != nil {
+		base = res.Request.URL
+	}
+	u, err := base.Parse(target)
+	if err != nil {
+		return target
+	}
+	return u.String()
+}
+
+// linkParamValue parses a token or quoted string parameter value, returning it
+// along with the remainder of the header.
+func linkParamValue(v string) (value, rest string) {
+	if !strings.HasPrefix(v, `"`) {
+		i := strings.IndexAny(v, ";,")
+		if i < 0 {
+			return strings.TrimSpace(v), ""
+		}
+		return strings.TrimSpace(v[:i]), v[i:]
+	}
+	var b strings.Builder
+	for i := 1; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			if i+1 < len(v) {
+				i++
+				b.WriteByte(v[i])
+			}
+		case '"':
+			return b.String(), v[i+1:]
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String(), ""
+}
+
+// readBody reads a bounded amount of the response body. Gzip encoded bodies
+// are decoded, with the bound applying to the decoded body.
+func readBody(res *http.Response) ([]byte, error) {
+	var r io.Reader = res.Body
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(res.Body)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return io.ReadAll(io.LimitReader(r, maxResponseBody))
 }
 
 // Urgency directly impacts battery life.
@@ -144,6 +384,38 @@ func (u Urgency) isValid() bool {
 	return false
 }
 
+// PushService identifies well known Push Service implementations.
+type PushService string
+
+const (
+	PushServiceUnknown   PushService = ""
+	PushServiceApple     PushService = "apple"
+	PushServiceGoogle    PushService = "google"
+	PushServiceMozilla   PushService = "mozilla"
+	PushServiceMicrosoft PushService = "microsoft"
+)
+
+// DetectPushService makes a best-guess of the PushService based on the
+// hostname of the endpoint.
+func DetectPushService(endpoint string) PushService {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return PushServiceUnknown
+	}
+	host := u.Hostname()
+	switch {
+	case host == "push.apple.com" || strings.HasSuffix(host, ".push.apple.com"):
+		return PushServiceApple
+	case host == "fcm.googleapis.com" || host == "android.googleapis.com":
+		return PushServiceGoogle
+	case strings.HasSuffix(host, ".push.services.mozilla.com"):
+		return PushServiceMozilla
+	case strings.HasSuffix(host, ".notify.windows.com"):
+		return PushServiceMicrosoft
+	}
+	return PushServiceUnknown
+}
+
 func b64Encoding(s string) *base64.Encoding {
 	hasPadding := len(s) > 0 && s[len(s)-1] == '='
 	isURL := false
@@ -202,44 +474,169 @@ func ParseVAPIDKey(privateKey string) (*ecdsa.PrivateKey, error) {
 	return ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
 }
 
+// origin returns the scheme and host of the endpoint, which is also the VAPID
+// audience. The host is lowercased, as it is case insensitive, so that every
+// Endpoint of a Push Service has the same origin.
+func origin(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("webpush: invalid endpoint: %q", endpoint)
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Host), nil
+}
+
+// Encoded VAPID public keys, keyed by a weak pointer to the private key.
+var vapidPublicKeys sync.Map
+
+// vapidPublicKey returns the Base64 Raw URL Encoded public key, memoized for
+// the lifetime of the private key.
+func vapidPublicKey(key *ecdsa.PrivateKey) (string, error) {
+	wp := weak.Make(key)
+	if v, ok := vapidPublicKeys.Load(wp); ok {
+		return v.(string), nil
+	}
+	publicKeyBytes, err := key.PublicKey.Bytes()
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(publicKeyBytes)
+	if _, loaded := vapidPublicKeys.LoadOrStore(wp, encoded); !loaded {
+		runtime.AddCleanup(key, func(wp weak.Pointer[ecdsa.PrivateKey]) {
+			vapidPublicKeys.Delete(wp)
+		}, wp)
+	}
+	return encoded, nil
+}
+
+// VAPIDKeyMatches reports if the Base64 encoded public key belongs to the
+// private key. This is useful to detect configuration drift when both are
+// stored separately.
+func VAPIDKeyMatches(privateKey *ecdsa.PrivateKey, publicKey string) (bool, error) {
+	raw, err := b64Decode(publicKey)
+	if err != nil {
+		return false, err
+	}
+	expected, err := privateKey.PublicKey.Bytes()
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(raw, expected), nil
+}
+
+// SubscribeOptions returns the options for pushManager.subscribe in the User
+// Agent, with userVisibleOnly set and the applicationServerKey being the
+// Base64 Raw URL Encoded VAPID public key. It can be marshalled as JSON for
+// use by the frontend.
+func SubscribeOptions(key *ecdsa.PrivateKey) (map[string]any, error) {
+	publicKey, err := vapidPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"userVisibleOnly":      true,
+		"applicationServerKey": publicKey,
+	}, nil
+}
+
 func makeAuthHeader(
 	endpoint,
 	subscriber string,
 	vapidKey *ecdsa.PrivateKey,
 	expiration time.Time,
 ) (string, error) {
-	subURL, err := url.Parse(endpoint)
+	token, publicKey, err := makeVAPIDToken(endpoint, subscriber, vapidKey, expiration, time.Time{}, nil)
 	if err != nil {
 		return "", err
 	}
-	if subURL.Scheme == "" || subURL.Host == "" {
-		return "", fmt.Errorf("webpush: invalid endpoint: %q", endpoint)
+	return formatVAPIDHeader(token, publicKey), nil
+}
+
+// formatVAPIDHeader is the standard Authorization header form.
+func formatVAPIDHeader(token, publicKey string) string {
+	return "vapid t=" + token + ", k=" + publicKey
+}
+
+// TokenExpiry returns the "exp" claim of the VAPID token in the Authorization
+// header of the request, in the standard "vapid t=<token>, k=<publicKey>"
+// form. The token signature is not verified. This allows for checking a
+// request built earlier is still valid before it is made, for example in an
+// http.RoundTripper that queues requests.
+func TokenExpiry(req *http.Request) (time.Time, bool) {
+	scheme, params, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "vapid") {
+		return time.Time{}, false
 	}
+	for param := range strings.SplitSeq(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if name != "t" {
+			continue
+		}
+		claims := jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(value, claims); err != nil {
+			return time.Time{}, false
+		}
+		exp, err := claims.GetExpirationTime()
+		if err != nil || exp == nil {
+			return time.Time{}, false
+		}
+		return exp.Time, true
+	}
+	return time.Time{}, false
+}
 
-	// Google & Firefox allow for empty Subscriber, but Apple doesn't.
-	if !strings.HasPrefix(subscriber, "https:") && !strings.HasPrefix(subscriber, "mailto:") {
-		return "", fmt.Errorf("webpush: invalid subscriber: %q", subscriber)
+// makeVAPIDToken returns the signed JWT and the encoded public key. The "iat"
+// claim is only included if issuedAt is not zero. The claims are signed with
+// sign if it is not nil.
+func makeVAPIDToken(
+	endpoint,
+	subscriber string,
+	vapidKey *ecdsa.PrivateKey,
+	expiration,
+	issuedAt time.Time,
+	sign func(claims map[string]any) (string, error),
+) (string, string, error) {
+	aud, err := origin(endpoint)
+	if err != nil {
+		return "", "", err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
-		"aud": subURL.Scheme + "://" + subURL.Host,
+	if !validSubscriber(subscriber) {
+		return "", "", fmt.Errorf("webpush: invalid subscriber: %q", subscriber)
+	}
+
+	claims := map[string]any{
+		"aud": aud,
 		"exp": expiration.Unix(),
 		"sub": subscriber,
-	})
-
-	jwtString, err := token.SignedString(vapidKey)
+	}
+	if !issuedAt.IsZero() {
+		claims["iat"] = issuedAt.Unix()
+	}
+	if sign == nil {
+		sign = func(claims map[string]any) (string, error) {
+			return jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims(claims)).SignedString(vapidKey)
+		}
+	}
+	jwtString, err := sign(claims)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	// TODO: memoize? weakmap?
-	publicKeyBytes, err := vapidKey.PublicKey.Bytes()
+	encodedPubicKey, err := vapidPublicKey(vapidKey)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	encodedPubicKey := base64.RawURLEncoding.EncodeToString(publicKeyBytes)
 
-	return "vapid t=" + jwtString + ", k=" + encodedPubicKey, nil
+	return jwtString, encodedPubicKey, nil
+}
+
+// validSubscriber reports if the subscriber is a https URL or mailto: address.
+// Google & Firefox allow for empty Subscriber, but Apple doesn't.
+func validSubscriber(subscriber string) bool {
+	return strings.HasPrefix(subscriber, "https:") || strings.HasPrefix(subscriber, "mailto:")
 }
 
 func hkdfExpand(length int, secret, salt, info []byte) ([]byte, error) {
@@ -251,26 +648,472 @@ func hkdfExpand(length int, secret, salt, info []byte) ([]byte, error) {
 
 // Client specifies required and optional aspects for sending a Push Notification.
 type Client struct {
-	Client          *http.Client      // Required http.Client.
+	Client          *http.Client      // Required http.Client, see NewHTTPClient.
 	VAPIDKey        *ecdsa.PrivateKey // Required VAPID Private Key.
 	Subscriber      string            // Required Subscriber, https URL or mailto: email address.
-	TTL             time.Duration     // Required TTL on the endpoint POST request (rounded to seconds).
+	TTL             time.Duration     // Required TTL on the endpoint POST request (rounded to seconds, 0 drops undeliverable messages).
 	Topic           string            // Optional Topic to collapse pending messages.
 	Urgency         Urgency           // Optional Urgency for message priority.
-	RecordSize      int               // Optional custom RecordSize, defaults to 4096 per spec.
+	RecordSize      int               // Optional custom RecordSize, defaults to 4096 per spec. Records are not padded to this size.
 	VAPIDExpiration time.Time         // Optional custom expiration for VAPID JWT token (defaults to now + 12 hours).
+	UserAgent       string            // Optional User-Agent header, defaults to "daaku-webpush".
+	Prefer          string            // Optional Prefer header, must be "respond-async" if set.
+
+	// Subscribers are optional fallbacks used when Subscriber is empty, the
+	// first valid one is used. This is useful for configuration assembled from
+	// multiple sources where some entries may be blank.
+	Subscribers []string
+
+	// ClockSkewTolerance optionally pads the VAPID "exp" claim and adds an
+	// "iat" claim backdated by this amount, to tolerate a Push Service clock
+	// that is ahead or behind. The padded expiration must still be within 24
+	// hours of the Push Service clock.
+	ClockSkewTolerance time.Duration
+
+	// ResyncClockOn401 retries a request rejected with a 401 once, with the
+	// VAPID token claims recomputed relative to the Date header of the
+	// response, which recovers from a Push Service clock that is skewed. The
+	// 401 is returned as is if the response has no valid Date header. With a
+	// TokenCache the offset from the Push Service clock is remembered for the
+	// origin, so later Sends use it without a rejected request.
+	ResyncClockOn401 bool
+
+	// Deadline optionally replaces the TTL with the time remaining until the
+	// Deadline at the time of each Send, rounded down to seconds. Once the
+	// Deadline has passed messages are sent with a TTL of 0.
+	Deadline time.Time
+
+	// StrictRecordSize returns an error instead of clamping RecordSize to 4096
+	// when sending to Apple, which rejects larger records.
+	StrictRecordSize bool
+
+	// OnDuration is an optional callback invoked once the request to the
+	// Endpoint completes, with a status of 0 if the request failed. It is only
+	// invoked for pushes, not for the HEAD requests made by Probe, Warm,
+	// Preflight and ClockSkew.
+	OnDuration func(d time.Duration, status int)
+
+	// OnAttempt is an optional callback invoked after every request made to
+	// the Endpoint, including a ResyncClockOn401 retry, with the attempt
+	// starting at 1. The status is 0 if the request failed, in which case err
+	// is the error making the request. Requests failed fast by the
+	// CircuitBreaker are not attempts.
+	OnAttempt func(attempt, status int, err error)
+
+	// EndpointRewrite optionally rewrites the URL the request is sent to, for
+	// example to route via a regional proxy. The VAPID audience is always
+	// derived from the original Endpoint.
+	EndpointRewrite func(endpoint string) string
+
+	// ECDH optionally performs the key agreement with the User Agent public
+	// key, returning the shared secret and the uncompressed application server
+	// public key. This allows for the application server key to live in a HSM.
+	// A fresh key must be used for every message. Defaults to generating an
+	// ephemeral key in-process.
+	ECDH func(userAgentPublicKey *ecdh.PublicKey) (sharedSecret, appServerPublicKey []byte, err error)
+
+	// Envelope optionally transforms the message before it is encrypted, for
+	// example to wrap it in an application specific signed envelope. The size
+	// limits apply to the transformed message.
+	Envelope func(message []byte) ([]byte, error)
+
+	// RecordTransform optionally transforms the encrypted aes128gcm record
+	// before it is sent as the body, for example to add framing expected by a
+	// gateway. Unlike the Envelope it operates on the encrypted record, and
+	// breaks interoperability unless the receiving side unwraps it before
+	// decryption. The Content-Length reflects the transformed record.
+	RecordTransform func(record []byte) ([]byte, error)
+
+	// VAPIDHeader optionally formats the Authorization header from the signed
+	// JWT and the encoded public key, for Push Services that require a
+	// non-standard form. Defaults to "vapid t=<token>, k=<publicKey>".
+	VAPIDHeader func(token, publicKey string) string
+
+	// Compress gzips the message before it is encrypted, after any Envelope,
+	// when ShouldCompress recommends it and doing so makes it smaller. It is
+	// opt-in as the Service Worker must cooperate: every message is prefixed
+	// with a single byte, CompressedGzip if the rest of the message is gzip
+	// compressed and CompressedNone if it is sent as is. The prefix counts
+	// towards the size limits.
+	Compress bool
+
+	// SignVAPID optionally signs the VAPID JWT claims, "aud", "exp" and "sub",
+	// returning the compact JWT. This allows for using an alternative JWT
+	// implementation. The signature must be ES256 using the VAPIDKey, whose
+	// public key is still sent in the Authorization header.
+	SignVAPID func(claims map[string]any) (string, error)
+
+	// NonceGuard is optionally consulted with the derived key and nonce of
+	// every message, for example with a NonceWindow.
+	NonceGuard NonceGuard
+
+	// RecordSink optionally receives a copy of every encrypted record before
+	// it is sent, for example to archive the exact bytes for compliance. Each
+	// record is written as a single line of JSON with the "endpoint", the
+	// "time" and the base64 encoded "record". The write happens synchronously
+	// so a slow sink slows down sending, and a failed write fails the Send.
+	// It must be safe for concurrent use if Sends are concurrent.
+	RecordSink io.Writer
+
+	// EmptyContentType is an optional Content-Type for SendEmpty, for Push
+	// Services that require one. It is omitted by default.
+	EmptyContentType string
+
+	// VAPIDLifetimes optionally sets the default VAPID token lifetime per Push
+	// Service, for those that reject the 12 hour default. It is only used when
+	// VAPIDExpiration is not set.
+	VAPIDLifetimes map[PushService]time.Duration
+
+	// DebugKeyMaterial sets the Result Salt and AppServerPublicKey, for
+	// auditing that every message uses fresh ephemeral values. These are sent
+	// in the clear in the record header, but are not exposed by default to
+	// avoid inadvertently logging them.
+	DebugKeyMaterial bool
+
+	// Events optionally receives an Event for every completed request made by
+	// the Send methods. The send is non-blocking, so if the channel is full
+	// the Event is dropped and counted in EventsDropped, if set.
+	Events        chan<- Event
+	EventsDropped *atomic.Int64
+
+	// TraceIDFromContext optionally returns a trace or request ID from the
+	// context passed to Send, such as one set by the HTTP handler that
+	// triggered the push. It is included in every Event, and sent as the
+	// TraceHeader if one is set.
+	TraceIDFromContext func(ctx context.Context) string
+
+	// TraceHeader is an optional request header name for the trace ID, such as
+	// "X-Request-ID". Note that the header is visible to the Push Service.
+	TraceHeader string
+
+	// CircuitBreaker optionally fails sends fast to a Push Service origin that
+	// is consistently failing.
+	CircuitBreaker *CircuitBreaker
+
+	// AsyncPool optionally bounds the concurrent sends made by SendAsync,
+	// defaulting to a pool shared by all Clients.
+	AsyncPool *WorkerPool
+
+	// TokenCache optionally memoizes signed VAPID tokens across Sends.
+	TokenCache *TokenCache
+
+	// OnTokenSigned is an optional callback invoked whenever a new VAPID token
+	// is signed, which with a TokenCache only happens on a cache miss.
+	OnTokenSigned func(origin string, expiration time.Time)
+
+	// attempt is the number of previous attempts of the request.
+	attempt int
+
+	// clockOffset is added to the local time for the VAPID claims, and is set
+	// when resyncing with the Push Service clock.
+	clockOffset time.Duration
+}
+
+// Resolved contains the values Send will use after applying defaults.
+type Resolved struct {
+	RecordSize      int
+	TTL             time.Duration
+	Topic           string
+	Urgency         Urgency
+	VAPIDExpiration time.Time
+	UserAgent       string
+	Subscriber      string
+}
+
+// Resolve returns the effective configuration after applying defaults. The
+// VAPIDExpiration default is relative to the current time. Note that Send may
+// further adjust some values for specific Push Services, see ResolveFor.
+func (c *Client) Resolve() Resolved {
+	r := Resolved{
+		RecordSize:      c.RecordSize,
+		TTL:             c.TTL,
+		Topic:           c.Topic,
+		Urgency:         c.Urgency,
+		VAPIDExpiration: c.VAPIDExpiration,
+		UserAgent:       c.UserAgent,
+		Subscriber:      c.subscriber(),
+	}
+	if !c.Deadline.IsZero() {
+		r.TTL = max(0, c.Deadline.Sub(timeNow()).Truncate(time.Second))
+	}
+	if r.RecordSize == 0 {
+		r.RecordSize = maxRecordSize
+	}
+	if r.VAPIDExpiration.IsZero() {
+		r.VAPIDExpiration = c.now().Add(defaultVAPIDLifetime)
+	}
+	if r.UserAgent == "" {
+		r.UserAgent = defaultUserAgent
+	}
+	return r
+}
+
+// now returns the current time for the VAPID claims.
+func (c *Client) now() time.Time {
+	return timeNow().Add(c.clockOffset)
+}
+
+// validate checks the Client has the fields required to Send.
+func (c *Client) validate() error {
+	if c.Client == nil {
+		return errors.New("webpush: missing http client")
+	}
+	if c.VAPIDKey == nil {
+		return errors.New("webpush: missing vapid key")
+	}
+	if subscriber := c.subscriber(); !validSubscriber(subscriber) {
+		return fmt.Errorf("webpush: invalid subscriber: %q", subscriber)
+	}
+	return nil
+}
+
+// subscriber returns the Subscriber, or the first valid one in Subscribers.
+func (c *Client) subscriber() string {
+	if c.Subscriber != "" {
+		return c.Subscriber
+	}
+	for _, s := range c.Subscribers {
+		if validSubscriber(s) {
+			return s
+		}
+	}
+	return ""
+}
+
+// recordSize returns the resolved record size, clamped for Apple which rejects
+// records larger than 4096 bytes.
+func (c *Client) recordSize(resolved Resolved, s *Subscription) int {
+	if resolved.RecordSize > maxRecordSize && DetectPushService(s.Endpoint) == PushServiceApple {
+		return maxRecordSize
+	}
+	return resolved.RecordSize
+}
+
+// ResolveFor is Resolve with the Push Service specific adjustments Send makes
+// for the Subscription, such as the Apple RecordSize limit and VAPIDLifetimes.
+func (c *Client) ResolveFor(s *Subscription) Resolved {
+	r := c.Resolve()
+	r.RecordSize = c.recordSize(r, s)
+	if c.VAPIDExpiration.IsZero() {
+		if lifetime, ok := c.VAPIDLifetimes[DetectPushService(s.Endpoint)]; ok {
+			r.VAPIDExpiration = c.now().Add(lifetime)
+		}
+	}
+	return r
+}
+
+// MaxPayload returns the largest message that can be sent to the Subscription,
+// accounting for the configured RecordSize, Push Service limits and the
+// Compress flag byte. Larger messages may still fit if they compress well.
+func (c *Client) MaxPayload(s *Subscription) int {
+	return c.ResolveFor(s).RecordSize - c.overhead()
+}
+
+// overhead returns the bytes added to every message, including the Compress
+// flag byte.
+func (c *Client) overhead() int {
+	if c.Compress {
+		return minOverhead + 1
+	}
+	return minOverhead
 }
 
 // Keys are the Base64 encoded values from the User Agent.
 type Keys struct {
-	Auth   string `json:"auth"`
 	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
 }
 
 // Subscription represents a PushSubscription from the User Agent.
+// The JSON form matches the output of PushSubscription.toJSON().
 type Subscription struct {
-	Endpoint string `json:"endpoint"`
-	Keys     Keys   `json:"keys"`
+	Endpoint       string `json:"endpoint"`
+	ExpirationTime *int64 `json:"expirationTime"` // Optional, milliseconds since the epoch.
+	Keys           Keys   `json:"keys"`
+
+	// Tag is an optional application defined identifier, for example the VAPID
+	// key the Subscription was created with. It is not used by Send.
+	Tag string `json:"tag,omitempty"`
+}
+
+// Validate checks the Subscription is structurally valid. It requires a https
+// Endpoint, a 16 byte auth secret and a valid P-256 public key.
+func (s *Subscription) Validate() error {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("webpush: invalid endpoint: %q", s.Endpoint)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("webpush: endpoint is not https: %q", s.Endpoint)
+	}
+	authSecret, err := b64Decode(s.Keys.Auth)
+	if err != nil {
+		return fmt.Errorf("webpush: invalid encoded auth in key: %w", err)
+	}
+	if len(authSecret) != 16 {
+		return fmt.Errorf("webpush: invalid auth length of %v, expected 16", len(authSecret))
+	}
+	userAgentPublicKeyBytes, err := b64Decode(s.Keys.P256dh)
+	if err != nil {
+		return fmt.Errorf("webpush: invalid encoded public key: %w", err)
+	}
+	if _, err := ecdh.P256().NewPublicKey(userAgentPublicKeyBytes); err != nil {
+		return fmt.Errorf("webpush: invalid user agent public key: %w", err)
+	}
+	return nil
+}
+
+// KeyInfo returns the decoded lengths of the auth secret and the P-256 public
+// key, and if they are the expected 16 and 65 bytes respectively. A length is
+// -1 if the value is not valid base64. This is useful to diagnose why a
+// Subscription collected from a User Agent is malformed. Unlike Validate, it
+// does not check the public key is a point on the curve.
+func (s *Subscription) KeyInfo() (authLen, p256dhLen int, valid bool) {
+	authLen, p256dhLen = -1, -1
+	if auth, err := b64Decode(s.Keys.Auth); err == nil {
+		authLen = len(auth)
+	}
+	if p256dh, err := b64Decode(s.Keys.P256dh); err == nil {
+		p256dhLen = len(p256dh)
+	}
+	return authLen, p256dhLen, authLen == 16 && p256dhLen == publicKeyLen
+}
+
+// OriginIn reports if the origin of the Endpoint is one of the origins, such
+// as "https://fcm.googleapis.com", compared case insensitively. This allows
+// for checking a stored Subscription still points at an approved Push Service
+// before sending to it. It is false if the Endpoint is invalid.
+func (s *Subscription) OriginIn(origins ...string) bool {
+	o, err := origin(s.Endpoint)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(origins, func(allowed string) bool {
+		return strings.EqualFold(strings.TrimSuffix(allowed, "/"), o)
+	})
+}
+
+// compactKeysLen is the length of the decoded keys prefix in the Compact form.
+const compactKeysLen = publicKeyLen + 16
+
+// Compact returns a URL safe encoding of the Subscription keys and Endpoint,
+// smaller than the JSON form and suitable for use in a QR code. The
+// ExpirationTime and Tag are not included. Use ParseCompact for the reverse.
+func (s *Subscription) Compact() (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+	userAgentPublicKey, _ := b64Decode(s.Keys.P256dh)
+	authSecret, _ := b64Decode(s.Keys.Auth)
+	return base64.RawURLEncoding.EncodeToString(
+		slices.Concat(userAgentPublicKey, authSecret, []byte(s.Endpoint))), nil
+}
+
+// ParseCompact parses a Subscription encoded by Compact.
+func ParseCompact(compact string) (*Subscription, error) {
+	b, err := base64.RawURLEncoding.DecodeString(compact)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid encoded compact subscription: %w", err)
+	}
+	if len(b) <= compactKeysLen {
+		return nil, fmt.Errorf("webpush: compact subscription length of %v is too short", len(b))
+	}
+	s := &Subscription{
+		Endpoint: string(b[compactKeysLen:]),
+		Keys: Keys{
+			P256dh: base64.RawURLEncoding.EncodeToString(b[:publicKeyLen]),
+			Auth:   base64.RawURLEncoding.EncodeToString(b[publicKeyLen:compactKeysLen]),
+		},
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Fields returns the Subscription as a flat map, with the "endpoint", "auth"
+// and "p256dh" keys, along with "expirationTime" and "tag" if they are set.
+// This is useful for structured logging or storing the fields separately.
+func (s *Subscription) Fields() map[string]string {
+	fields := map[string]string{
+		"endpoint": s.Endpoint,
+		"auth":     s.Keys.Auth,
+		"p256dh":   s.Keys.P256dh,
+	}
+	if s.ExpirationTime != nil {
+		fields["expirationTime"] = strconv.FormatInt(*s.ExpirationTime, 10)
+	}
+	if s.Tag != "" {
+		fields["tag"] = s.Tag
+	}
+	return fields
+}
+
+// SubscriptionFromFields is the reverse of Fields.
+func SubscriptionFromFields(fields map[string]string) (*Subscription, error) {
+	s := &Subscription{
+		Endpoint: fields["endpoint"],
+		Keys: Keys{
+			Auth:   fields["auth"],
+			P256dh: fields["p256dh"],
+		},
+		Tag: fields["tag"],
+	}
+	if s.Endpoint == "" || s.Keys.Auth == "" || s.Keys.P256dh == "" {
+		return nil, fmt.Errorf(
+			"webpush: invalid subscription, missing endpoint or keys")
+	}
+	if v, ok := fields["expirationTime"]; ok {
+		expirationTime, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("webpush: invalid expiration time %q: %w", v, err)
+		}
+		s.ExpirationTime = &expirationTime
+	}
+	return s, nil
+}
+
+// fcmSendEndpoint is the Endpoint prefix for a Google registration ID.
+const fcmSendEndpoint = "https://fcm.googleapis.com/fcm/send/"
+
+// SubscriptionFromGCM returns a Subscription for a legacy GCM registration ID,
+// using the current FCM Endpoint for it. This is useful for migrating stored
+// data that predates full Endpoints. The keys are the legacy subscription keys
+// from the User Agent. A returned error indicates the registration ID is
+// empty or not a bare ID.
+func SubscriptionFromGCM(registrationID string, keys Keys) (*Subscription, error) {
+	if registrationID == "" {
+		return nil, errors.New("webpush: missing gcm registration id")
+	}
+	if strings.ContainsAny(registrationID, "/?#% \t\r\n") {
+		return nil, fmt.Errorf("webpush: invalid gcm registration id: %q", registrationID)
+	}
+	return &Subscription{Endpoint: fcmSendEndpoint + registrationID, Keys: keys}, nil
+}
+
+// PartitionValid splits subs into ones that pass Validate and ones that don't.
+// This is useful to prune malformed Subscriptions before sending to many.
+func PartitionValid(subs []*Subscription) (valid, invalid []*Subscription) {
+	for _, s := range subs {
+		if s.Validate() == nil {
+			valid = append(valid, s)
+		} else {
+			invalid = append(invalid, s)
+		}
+	}
+	return valid, invalid
+}
+
+// GroupByOrigin buckets subs by the origin of their Endpoint, for example
+// "https://fcm.googleapis.com", with the host lowercased. Subscriptions with an unparseable Endpoint are
+// grouped under the empty string.
+func GroupByOrigin(subs []*Subscription) map[string][]*Subscription {
+	groups := make(map[string][]*Subscription)
+	for _, s := range subs {
+		o, _ := origin(s.Endpoint)
+		groups[o] = append(groups[o], s)
+	}
+	return groups
 }
 
 var (
@@ -279,156 +1122,652 @@ var (
 	nonceInfo                = []byte("Content-Encoding: nonce\x00")
 )
 
-// Send a Push Notification to a Subscription.
-// Send will return an error of type Error if the Endpoint returns a HTTP
-// response with a status code outside the 200-299 range.
-func (c *Client) Send(ctx context.Context, message []byte, s *Subscription) error {
-	recordSize := c.RecordSize
-	if recordSize == 0 {
-		recordSize = maxRecordSize
+// ephemeralECDH generates a new application server key and derives the shared
+// secret with it.
+func ephemeralECDH(userAgentPublicKey *ecdh.PublicKey) (sharedSecret, appServerPublicKey []byte, err error) {
+	appServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("webpush: failed to generate application server key: %w", err)
 	}
+	sharedSecret, err = appServerPrivateKey.ECDH(userAgentPublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("webpush: failed to derive shared secret: %w", err)
+	}
+	return sharedSecret, appServerPrivateKey.PublicKey().Bytes(), nil
+}
 
-	if s.Endpoint == "" || s.Keys.Auth == "" || s.Keys.P256dh == "" {
-		return fmt.Errorf(
-			"webpush: invalid subscription, missing endpoint or keys")
+// ttlSeconds converts the TTL to whole seconds. A TTL of 0 asks the Push
+// Service to deliver immediately or drop the message, so positive sub-second
+// values round up to 1 second instead.
+func ttlSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
 	}
+	return max(1, int(ttl/time.Second))
+}
+
+// SendOption overrides a Client field for a single Send, leaving the Client
+// itself unchanged.
+type SendOption func(*Client)
 
-	if len(message) > recordSize-minOverhead {
-		return fmt.Errorf(
-			"webpush: message length of %v is too long for record size of %v",
-			len(message), recordSize)
+// WithSubscriber overrides the Subscriber.
+func WithSubscriber(subscriber string) SendOption {
+	return func(c *Client) {
+		c.Subscriber = subscriber
 	}
+}
 
-	authSecret, err := b64Decode(s.Keys.Auth)
+// WithTopic overrides the Topic.
+func WithTopic(topic string) SendOption {
+	return func(c *Client) {
+		c.Topic = topic
+	}
+}
+
+// TopicFromKey derives a valid Topic from an arbitrary key, such as a user ID
+// and notification type, by hashing it. The Topic is deterministic, and is
+// the 32 character maximum using the URL and filename safe base64 alphabet
+// required by RFC 8030.
+func TopicFromKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(sum[:24])
+}
+
+// WithUrgency overrides the Urgency.
+func WithUrgency(urgency Urgency) SendOption {
+	return func(c *Client) {
+		c.Urgency = urgency
+	}
+}
+
+// WithDeadline overrides the Deadline.
+func WithDeadline(deadline time.Time) SendOption {
+	return func(c *Client) {
+		c.Deadline = deadline
+	}
+}
+
+// WithTTL overrides the TTL.
+func WithTTL(ttl time.Duration) SendOption {
+	return func(c *Client) {
+		c.TTL = ttl
+	}
+}
+
+// State is the delivery state of a message.
+type State string
+
+const (
+	// StateAccepted means the Push Service accepted the message for delivery,
+	// which does not mean the User Agent has received it.
+	StateAccepted State = "accepted"
+
+	// StateDelivered means the Push Service confirmed delivery to the User
+	// Agent, which is only known via push receipts.
+	StateDelivered State = "delivered"
+)
+
+// Result describes a message successfully handed off to the Push Service.
+// Success means the message was accepted, not that it was delivered.
+type Result struct {
+	// State is StateAccepted for every successful response.
+	State State
+
+	// StatusCode is the HTTP status code, typically 201 but some Push Services
+	// respond with 200 or 202.
+	StatusCode int
+
+	// Location is the URL of the message resource, which can be used as a
+	// message ID. It is optional and may be empty even for a 201 response.
+	Location string
+
+	// Receipt is the push receipt subscription URL from the Link header, if the
+	// Push Service supports receipts as described in RFC 8030 section 5.1. A
+	// relative target is resolved against the request URL.
+	Receipt string
+
+	// AcceptedTTL is the TTL the Push Service applied, if it echoed one in the
+	// response as described in RFC 8030 section 5.2. It may be lower than the
+	// requested TTL, and is nil if the header is absent or malformed.
+	AcceptedTTL *time.Duration
+
+	// Salt and AppServerPublicKey are the ephemeral values used to encrypt the
+	// message, which are only set with the Client DebugKeyMaterial.
+	Salt               []byte
+	AppServerPublicKey []byte
+}
+
+// Send a Push Notification to a Subscription.
+// Send will return an error of type Error if the Endpoint returns a HTTP
+// response with a status code outside the 200-299 range. The context is
+// checked before encrypting the message, and is used for the request.
+func (c *Client) Send(ctx context.Context, message []byte, s *Subscription, opts ...SendOption) error {
+	_, err := c.withOptions(opts).send(ctx, message, &PreparedSubscription{Subscription: s}, nil)
+	return err
+}
+
+// Push is like Send, but also returns the Result of a successful delivery.
+func (c *Client) Push(ctx context.Context, message []byte, s *Subscription, opts ...SendOption) (*Result, error) {
+	return c.withOptions(opts).send(ctx, message, &PreparedSubscription{Subscription: s}, nil)
+}
+
+// SendCollapsed is like Send, but with a Topic derived from the collapseKey
+// using TopicFromKey, so a pending message with the same collapseKey is
+// replaced rather than stacked. The Topic takes precedence over any option.
+func (c *Client) SendCollapsed(ctx context.Context, message []byte, s *Subscription, collapseKey string, opts ...SendOption) error {
+	opts = append(slices.Clip(opts), WithTopic(TopicFromKey(collapseKey)))
+	return c.Send(ctx, message, s, opts...)
+}
+
+// Migrate sends to the newer Subscription, falling back to the older one if
+// the newer one is permanently gone, as may be needed while handling the
+// pushsubscriptionchange event. The Subscription that accepted the message is
+// returned along with the Result. The error from the older Subscription is
+// returned if both fail.
+func (c *Client) Migrate(ctx context.Context, message []byte, older, newer *Subscription, opts ...SendOption) (*Subscription, *Result, error) {
+	result, err := c.Push(ctx, message, newer, opts...)
+	if err == nil {
+		return newer, result, nil
+	}
+	if pushErr, ok := errors.AsType[*Error](err); !ok || !pushErr.Permanent {
+		return nil, nil, err
+	}
+	result, err = c.Push(ctx, message, older, opts...)
 	if err != nil {
-		return fmt.Errorf("webpush: invalid encoded auth in key: %w", err)
+		return nil, nil, err
 	}
+	return older, result, nil
+}
 
-	userAgentPublicKeyBytes, err := b64Decode(s.Keys.P256dh)
+// send is Push with an optional hook that can inspect and veto the request
+// before it is made.
+func (c *Client) send(ctx context.Context, message []byte, p *PreparedSubscription, before func(*http.Request) error) (*Result, error) {
+	req, record, err := c.newRequest(ctx, message, p)
 	if err != nil {
-		return fmt.Errorf("webpush: invalid encoded public key: %w", err)
+		return nil, err
 	}
 
-	salt := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return fmt.Errorf("webpush: failed to create salt: %w", err)
+	if before != nil {
+		if err := before(req); err != nil {
+			return nil, err
+		}
 	}
 
-	// New Key for this Message
-	appServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err := c.archive(req, p.Subscription.Endpoint); err != nil {
+		return nil, err
+	}
+
+	result, err := c.result(req, p.Subscription.Endpoint)
 	if err != nil {
-		return fmt.Errorf("webpush: failed to generate application server key: %w", err)
+		return nil, err
 	}
-	appServerPublicKeyBytes := appServerPrivateKey.PublicKey().Bytes()
+	if c.DebugKeyMaterial {
+		result.Salt = bytes.Clone(record[:16])
+		result.AppServerPublicKey = bytes.Clone(record[21:headerLen])
+	}
+	return result, nil
+}
 
-	userAgentPublicKey, err := ecdh.P256().NewPublicKey(userAgentPublicKeyBytes)
+// result makes the request, returning the Result for a successful response
+// or an Error otherwise.
+func (c *Client) result(req *http.Request, endpoint string) (*Result, error) {
+	res, body, err := c.doEndpoint(req, endpoint)
 	if err != nil {
-		return fmt.Errorf("webpush: invalid user agent public key: %w", err)
+		return nil, err
 	}
 
-	// Derive Shared Secret for this Message
-	sharedSecret, err := appServerPrivateKey.ECDH(userAgentPublicKey)
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return &Result{
+			State:       StateAccepted,
+			StatusCode:  res.StatusCode,
+			Location:    res.Header.Get("Location"),
+			Receipt:     resolveLink(req, res, linkWithRel(res.Header.Values("Link"), receiptRel)),
+			AcceptedTTL: parseTTL(res.Header.Get("TTL")),
+		}, nil
+	}
+
+	if res.StatusCode == http.StatusUnauthorized && c.ResyncClockOn401 {
+		if resynced, retry := c.resync(req, endpoint, res); retry != nil {
+			return resynced.result(retry, endpoint)
+		}
+	}
+	return nil, newError(endpoint, res, body)
+}
+
+// resync returns a Client using the clock of the Push Service as indicated by
+// the Date header of the response, along with a copy of the request with a
+// VAPID token signed using that clock. The request is nil if it cannot be
+// retried.
+func (c *Client) resync(req *http.Request, endpoint string, res *http.Response) (*Client, *http.Request) {
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil || req.GetBody == nil {
+		return nil, nil
+	}
+	aud, err := origin(endpoint)
+	if err != nil {
+		return nil, nil
+	}
+	offset := date.Sub(timeNow().Truncate(time.Second))
+	resynced := *c
+	resynced.ResyncClockOn401 = false
+	resynced.attempt++
+	if cache := c.tokenCache(); cache != nil {
+		// replaces the rejected token, and later tokens for the origin are
+		// signed using the offset
+		cache.resync(aud, offset)
+	} else {
+		resynced.clockOffset = offset
+		if !c.VAPIDExpiration.IsZero() {
+			resynced.VAPIDExpiration = c.VAPIDExpiration.Add(offset)
+		}
+	}
+	expiration := resynced.ResolveFor(&Subscription{Endpoint: endpoint}).VAPIDExpiration
+	auth, err := resynced.authHeader(endpoint, expiration)
+	if err != nil {
+		return nil, nil
+	}
+	body, err := req.GetBody()
 	if err != nil {
-		return fmt.Errorf("webpush: failed to derive shared secret: %w", err)
+		return nil, nil
 	}
+	retry := req.Clone(req.Context())
+	retry.Body = body
+	retry.Header.Set("Authorization", auth)
+	return &resynced, retry
+}
 
-	// Derive IKM
-	keyInfo := slices.Concat(webPushInfo, userAgentPublicKeyBytes, appServerPublicKeyBytes)
-	ikm, err := hkdfExpand(32, sharedSecret, authSecret, keyInfo)
+// SendEmpty sends a Push Notification without a payload, which wakes the
+// Service Worker with a push event that has no data. The request has no body,
+// an explicit "Content-Length: 0", and no Content-Encoding or Content-Type
+// unless EmptyContentType is set.
+func (c *Client) SendEmpty(ctx context.Context, s *Subscription, opts ...SendOption) error {
+	c = c.withOptions(opts)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.Endpoint == "" {
+		return fmt.Errorf("webpush: invalid subscription, missing endpoint")
+	}
+	req, err := c.newPushRequest(ctx, s, c.ResolveFor(s), http.NoBody)
 	if err != nil {
-		return fmt.Errorf("webpush: failed to derive ikm: %w", err)
+		return err
+	}
+	req.ContentLength = 0
+	// allows for the request to be retried, such as by ResyncClockOn401
+	req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+	if c.EmptyContentType != "" {
+		req.Header.Set("Content-Type", c.EmptyContentType)
 	}
+	_, err = c.result(req, s.Endpoint)
+	return err
+}
 
-	// Derive Content Encryption Key
-	contentEncryptionKey, err := hkdfExpand(16, ikm, salt, contentEncryptionKeyInfo)
+// SendAndForget sends a Push Notification, ignoring the response from the
+// Endpoint. Only errors encountered before or while making the request are
+// returned. As with Send, at most the first 4 KiB of the response body are
+// read before it is closed, so a larger body prevents reusing the connection.
+func (c *Client) SendAndForget(ctx context.Context, message []byte, s *Subscription, opts ...SendOption) error {
+	c = c.withOptions(opts)
+	req, _, err := c.newRequest(ctx, message, &PreparedSubscription{Subscription: s})
 	if err != nil {
-		return fmt.Errorf("webpush: failed to derive content encryption key: %w", err)
+		return err
+	}
+	if err := c.archive(req, s.Endpoint); err != nil {
+		return err
 	}
+	_, _, err = c.doEndpoint(req, s.Endpoint)
+	return err
+}
 
-	// Derive Nonce
-	nonce, err := hkdfExpand(12, ikm, salt, nonceInfo)
+// RequestSize returns the approximate size of the request Send would make,
+// including the request line, the headers such as the VAPID Authorization,
+// and the encrypted body. This is useful for diagnosing Push Services that
+// limit the total request size. The size is that of the HTTP/1.1 form, HTTP/2
+// compresses the headers and is usually smaller. Nothing is sent.
+func (c *Client) RequestSize(ctx context.Context, message []byte, s *Subscription, opts ...SendOption) (int, error) {
+	req, _, err := c.withOptions(opts).newRequest(ctx, message, &PreparedSubscription{Subscription: s})
 	if err != nil {
-		return fmt.Errorf("webpush: failed to derive nonce: %w", err)
+		return 0, err
 	}
+	var w countWriter
+	if err := req.Write(&w); err != nil {
+		return 0, fmt.Errorf("webpush: failed to measure request: %w", err)
+	}
+	return int(w), nil
+}
+
+// countWriter counts and discards the bytes written.
+type countWriter int
 
-	// AES + GCM
-	aesCipher, err := aes.NewCipher(contentEncryptionKey)
+func (w *countWriter) Write(b []byte) (int, error) {
+	*w += countWriter(len(b))
+	return len(b), nil
+}
+
+// archivedRecord is the RecordSink entry.
+type archivedRecord struct {
+	Endpoint string    `json:"endpoint"`
+	Time     time.Time `json:"time"`
+	Record   []byte    `json:"record"`
+}
+
+// archive writes the request body to the RecordSink, if one is configured.
+func (c *Client) archive(req *http.Request, endpoint string) error {
+	if c.RecordSink == nil {
+		return nil
+	}
+	body, err := req.GetBody()
 	if err != nil {
-		return fmt.Errorf("webpush: invalid generated content encryption key: %w", err)
+		return fmt.Errorf("webpush: failed to archive record: %w", err)
 	}
-	gcm, err := cipher.NewGCM(aesCipher)
+	record, err := io.ReadAll(body)
 	if err != nil {
-		return fmt.Errorf("webpush: invalid content encryption cipher: %w", err)
+		return fmt.Errorf("webpush: failed to archive record: %w", err)
+	}
+	entry, err := json.Marshal(archivedRecord{Endpoint: endpoint, Time: timeNow(), Record: record})
+	if err != nil {
+		return fmt.Errorf("webpush: failed to archive record: %w", err)
+	}
+	if _, err := c.RecordSink.Write(append(entry, '\n')); err != nil {
+		return fmt.Errorf("webpush: failed to archive record: %w", err)
+	}
+	return nil
+}
+
+// The first byte of every message sent with Compress, indicating if the rest
+// of the message is compressed.
+const (
+	CompressedNone byte = 0
+	CompressedGzip byte = 1
+)
+
+// maxCompressEntropy is the byte entropy, in bits per byte, above which a
+// message is unlikely to compress well. Text such as JSON is typically below 6,
+// while compressed or encrypted data is close to 8.
+const maxCompressEntropy = 7.0
+
+// ShouldCompress reports if compressing the message is likely to be worthwhile
+// for the record size, which defaults to 4096 if zero. Compression is only
+// recommended for messages that use at least half of the maximum payload, as
+// smaller messages fit as is, and that appear compressible based on their byte
+// entropy. Messages that are already gzip compressed are never recommended.
+func ShouldCompress(message []byte, recordSize int) bool {
+	if recordSize == 0 {
+		recordSize = maxRecordSize
+	}
+	if len(message) < (recordSize-minOverhead)/2 || bytes.HasPrefix(message, []byte{0x1f, 0x8b}) {
+		return false
+	}
+	var counts [256]int
+	for _, b := range message {
+		counts[b]++
+	}
+	var entropy float64
+	total := float64(len(message))
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy < maxCompressEntropy
+}
+
+// gzipMessage compresses the message using gzip.
+func gzipMessage(message []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: failed to compress message: %w", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return nil, fmt.Errorf("webpush: failed to compress message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("webpush: failed to compress message: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// withOptions returns a Client with the options applied, leaving the original
+// unchanged.
+func (c *Client) withOptions(opts []SendOption) *Client {
+	if len(opts) == 0 {
+		return c
+	}
+	override := *c
+	for _, o := range opts {
+		o(&override)
+	}
+	return &override
+}
+
+// newRequest encrypts the message and prepares the request to the Endpoint,
+// also returning the encrypted record before any RecordTransform.
+func (c *Client) newRequest(ctx context.Context, message []byte, p *PreparedSubscription) (*http.Request, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	s := p.Subscription
+	resolved := c.ResolveFor(s)
+	recordSize := resolved.RecordSize
+	if c.StrictRecordSize && recordSize < c.RecordSize {
+		return nil, nil, fmt.Errorf(
+			"webpush: record size %v exceeds Apple's %v limit", c.RecordSize, maxRecordSize)
+	}
+
+	if s.Endpoint == "" || s.Keys.Auth == "" || s.Keys.P256dh == "" {
+		return nil, nil, fmt.Errorf(
+			"webpush: invalid subscription, missing endpoint or keys")
+	}
+
+	if c.Envelope != nil {
+		var err error
+		message, err = c.Envelope(message)
+		if err != nil {
+			return nil, nil, fmt.Errorf("webpush: failed to envelope message: %w", err)
+		}
 	}
 
-	// Single allocation byte slice in which we write the header, message,
-	// delimiter and padding. We then Seal the message and write the resulting
-	// ciphertext replacing the plaintext message in the same byte slice.
-	record := make([]byte, 0, minOverhead+len(message))
-	record = append(record, salt...)
-	record = binary.BigEndian.AppendUint32(record, uint32(recordSize))
-	record = append(record, byte(len(appServerPublicKeyBytes)))
-	record = append(record, appServerPublicKeyBytes...)
-	record = append(record, message...)
-	record = append(record, '\x02')
-	gcm.Seal(
-		// replace plaintext in-place with ciphertext
-		record[headerLen:headerLen],
-		nonce,
-		// pad until capacity accounting for overhead
-		record[headerLen:cap(record)-gcm.Overhead()],
-		nil)
-	record = record[0:cap(record)] // resize to header + gcm overhead
+	if c.Compress {
+		length := len(message)
+		flag := CompressedNone
+		if ShouldCompress(message, recordSize) {
+			compressed, err := gzipMessage(message)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(compressed) < len(message) {
+				flag, message = CompressedGzip, compressed
+			}
+		}
+		message = append([]byte{flag}, message...)
+		// reports the length without the flag byte, which the caller did not
+		// write
+		if len(message) > recordSize-minOverhead {
+			return nil, nil, fmt.Errorf(
+				"webpush: message length of %v is too long for record size of %v",
+				length, recordSize)
+		}
+	}
 
-	req, err := http.NewRequest("POST", s.Endpoint, bytes.NewReader(record))
+	record, err := encrypt(message, p, &EncryptOptions{
+		RecordSize: recordSize,
+		ECDH:       c.ECDH,
+		NonceGuard: c.NonceGuard,
+	})
 	if err != nil {
-		return fmt.Errorf("webpush: invalid endpoint request: %w", err)
+		return nil, nil, err
+	}
+	body := record
+	if c.RecordTransform != nil {
+		body, err = c.RecordTransform(record)
+		if err != nil {
+			return nil, nil, fmt.Errorf("webpush: failed to transform record: %w", err)
+		}
 	}
 
+	req, err := c.newPushRequest(ctx, s, resolved, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Some Push Services reject chunked requests, so the length is set
+	// explicitly rather than relying on it being inferred from the body.
+	req.ContentLength = int64(len(body))
 	req.Header.Set("Content-Encoding", "aes128gcm")
 	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Header.Set("TTL", strconv.Itoa(int(c.TTL.Seconds())))
+	return req, record, nil
+}
 
-	if c.Topic != "" {
-		req.Header.Set("Topic", c.Topic)
+// newPushRequest prepares the request to the Endpoint with the body, setting
+// the headers common to every push.
+func (c *Client) newPushRequest(ctx context.Context, s *Subscription, resolved Resolved, body io.Reader) (*http.Request, error) {
+	target := s.Endpoint
+	if c.EndpointRewrite != nil {
+		target = c.EndpointRewrite(target)
 	}
-	if c.Urgency != "" {
-		if !c.Urgency.isValid() {
-			return fmt.Errorf("webpush: invalid urgency %q", c.Urgency)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target, body)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: invalid endpoint request: %w", err)
+	}
+
+	req.Header.Set("TTL", strconv.Itoa(ttlSeconds(resolved.TTL)))
+	req.Header.Set("User-Agent", resolved.UserAgent)
+	if c.TraceIDFromContext != nil && c.TraceHeader != "" {
+		if id := c.TraceIDFromContext(ctx); id != "" {
+			req.Header.Set(c.TraceHeader, id)
 		}
-		req.Header.Set("Urgency", string(c.Urgency))
 	}
 
-	expiration := c.VAPIDExpiration
-	if expiration.IsZero() {
-		expiration = time.Now().Add(time.Hour * 12)
+	if resolved.Topic != "" {
+		req.Header.Set("Topic", resolved.Topic)
+	}
+	if resolved.Urgency != "" {
+		if !resolved.Urgency.isValid() {
+			return nil, fmt.Errorf("webpush: invalid urgency %q", resolved.Urgency)
+		}
+		req.Header.Set("Urgency", string(resolved.Urgency))
+	}
+	// RFC 8030 only defines respond-async, used to request push receipts.
+	// Most Push Services ignore it.
+	if c.Prefer != "" {
+		if c.Prefer != "respond-async" {
+			return nil, fmt.Errorf("webpush: invalid prefer %q", c.Prefer)
+		}
+		req.Header.Set("Prefer", c.Prefer)
 	}
 
-	authHeader, err := makeAuthHeader(
-		s.Endpoint,
-		c.Subscriber,
-		c.VAPIDKey,
-		expiration,
-	)
+	authHeader, err := c.authHeader(s.Endpoint, resolved.VAPIDExpiration)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("Authorization", authHeader)
+	return req, nil
+}
 
+// doEndpoint is do for a push to the Endpoint, consulting the CircuitBreaker,
+// calling OnAttempt and emitting the Event.
+func (c *Client) doEndpoint(req *http.Request, endpoint string) (*http.Response, []byte, error) {
+	var breakerOrigin string
+	if c.CircuitBreaker != nil {
+		breakerOrigin, _ = origin(endpoint)
+		if err := c.CircuitBreaker.allow(breakerOrigin); err != nil {
+			return nil, nil, err
+		}
+	}
+	start := time.Now()
+	res, body, err := c.do(req)
+	var status int
+	if res != nil {
+		status = res.StatusCode
+	}
+	if c.OnDuration != nil {
+		c.OnDuration(time.Since(start), status)
+	}
+	if c.CircuitBreaker != nil {
+		c.CircuitBreaker.record(req, breakerOrigin, res, err)
+	}
+	if c.OnAttempt != nil {
+		c.OnAttempt(c.attempt+1, status, err)
+	}
+	c.emit(req, endpoint, start, res, body, err)
+	return res, body, err
+}
+
+// do makes the request, returning the response along with a bounded amount of
+// the body. The response body is always closed.
+func (c *Client) do(req *http.Request) (*http.Response, []byte, error) {
 	res, err := c.Client.Do(req)
 	if err != nil {
-		return fmt.Errorf("webpush: error making request to subscription endpoint: %w", err)
+		return nil, nil, fmt.Errorf("webpush: error making request to subscription endpoint: %w", err)
 	}
 	defer res.Body.Close()
 
-	body, err := io.ReadAll(io.LimitReader(res.Body, 4096))
+	body, err := readBody(res)
 	if err != nil {
-		return fmt.Errorf("webpush: error reading response body from subscription endpoint: %w", err)
+		// the message was accepted, so an undecodable body is not a failure
+		if res.StatusCode >= 200 && res.StatusCode <= 299 {
+			return res, nil, nil
+		}
+		return nil, nil, fmt.Errorf("webpush: error reading response body from subscription endpoint: %w", err)
 	}
+	return res, body, nil
+}
 
-	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+// WorkerPool bounds the number of concurrent sends made by SendAsync. The
+// zero value is ready to use, and it must not be copied after first use.
+type WorkerPool struct {
+	Size int // Optional limit on concurrent sends, defaults to 16.
+
+	once  sync.Once
+	slots chan struct{}
+}
+
+// defaultWorkerPool is used by Clients without an AsyncPool.
+var defaultWorkerPool WorkerPool
+
+// acquire waits for a slot in the pool, or the context to be done.
+func (p *WorkerPool) acquire(ctx context.Context) error {
+	p.once.Do(func() {
+		size := p.Size
+		if size <= 0 {
+			size = defaultConcurrency
+		}
+		p.slots = make(chan struct{}, size)
+	})
+	select {
+	case p.slots <- struct{}{}:
 		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+// release frees a slot in the pool.
+func (p *WorkerPool) release() {
+	<-p.slots
+}
 
-	return newError(s.Endpoint, res, body)
+// SendAsync sends the Push Notification on the AsyncPool, or a shared pool of
+// 16 workers if one is not set. It waits for a slot in the pool, and then
+// returns a buffered channel that receives exactly one value, the error
+// returned by Send. The context is used for the request, so cancelling it
+// results in a cancellation error being delivered, including while waiting
+// for a slot.
+func (c *Client) SendAsync(ctx context.Context, message []byte, s *Subscription, opts ...SendOption) <-chan error {
+	result := make(chan error, 1)
+	pool := c.AsyncPool
+	if pool == nil {
+		pool = &defaultWorkerPool
+	}
+	if err := pool.acquire(ctx); err != nil {
+		result <- err
+		return result
+	}
+	go func() {
+		defer pool.release()
+		result <- c.Send(ctx, message, s, opts...)
+	}()
+	return result
 }
@@ -2,8 +2,12 @@ package webpush
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +15,10 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"testing/cryptotest"
 	"time"
@@ -28,6 +36,20 @@ var (
 			P256dh: "BOaRpSCtjsB92YouZnj8iNgCdFDNVNbid40AGxLcR47DI1S-zQkYf1CDG2G4y9GXeg74-8U_mEMzSZc-mRF_X0Y",
 		},
 	}
+	// RFC 8291 Appendix A example values.
+	rfc8291Subscription = Subscription{
+		Endpoint: "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV",
+		Keys: Keys{
+			Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+			P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+		},
+	}
+	rfc8291UserAgentPrivateKey = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291AppServerPrivateKey = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfc8291Salt                = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfc8291Plaintext           = "When I grow up, I want to be a watermelon"
+	rfc8291Body                = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+
 	validSubscriptionEndpointOrigin = "https://the.push.server"
 	validHTTPSSubscriber            = "https://app.server/"
 	validMailtoSubscriber           = "mailto:admin@app.server"
@@ -41,6 +63,23 @@ func must[T any](v T, err error) T {
 	panic(fmt.Sprintf("error: %+v", err))
 }
 
+// authClaims returns the unverified VAPID claims from the request.
+func authClaims(t testing.TB, r *http.Request) jwt.MapClaims {
+	t.Helper()
+	token, _, ok := strings.Cut(strings.TrimPrefix(r.Header.Get("Authorization"), "vapid t="), ", k=")
+	ensure.True(t, ok, "expected vapid authorization header")
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	ensure.Nil(t, err)
+	return claims
+}
+
+func pinTime(t testing.TB, now time.Time) {
+	original := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = original })
+}
+
 type transportFunc func(*http.Request) (*http.Response, error)
 
 func (f transportFunc) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -53,6 +92,25 @@ func TestUrgencyValid(t *testing.T) {
 	ensure.False(t, Urgency("foo").isValid())
 }
 
+func TestDetectPushService(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		service  PushService
+	}{
+		{"https://web.push.apple.com/QC01kYdRpQOe", PushServiceApple},
+		{"https://fcm.googleapis.com/fcm/send/cVGTCKN07V8", PushServiceGoogle},
+		{"https://updates.push.services.mozilla.com/wpush/v2/gAAAAABqCo", PushServiceMozilla},
+		{"https://wns2-par02p.notify.windows.com/w/?token=BQYAAA", PushServiceMicrosoft},
+		{validSubscription.Endpoint, PushServiceUnknown},
+		{"::", PushServiceUnknown},
+	}
+	for _, c := range cases {
+		t.Run(c.endpoint, func(t *testing.T) {
+			ensure.DeepEqual(t, DetectPushService(c.endpoint), c.service)
+		})
+	}
+}
+
 func TestB64Decode(t *testing.T) {
 	raw := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 3, 239}
 	cases := []struct {
@@ -89,6 +147,38 @@ func TestParseVAPIDKey(t *testing.T) {
 	ensure.NotNil(t, key)
 }
 
+func TestSubscribeOptions(t *testing.T) {
+	options, err := SubscribeOptions(validVapidKey)
+	ensure.Nil(t, err)
+	publicKey := must(vapidPublicKey(validVapidKey))
+	ensure.DeepEqual(t, options["applicationServerKey"], publicKey)
+	ensure.True(t, must(VAPIDKeyMatches(validVapidKey, publicKey)))
+	ensure.DeepEqual(t, string(must(json.Marshal(options))),
+		`{"applicationServerKey":"`+publicKey+`","userVisibleOnly":true}`)
+}
+
+func TestVAPIDKeyMatches(t *testing.T) {
+	const publicKey = "BBRS0hDoszIXnLVNyR3EbnXnN4glsvb6AusPR9e9L93ZWHeKO4mYTWjpwa5w2xwc0sZBIBIQ-RtwDgE7BZqRWc0"
+	matches, err := VAPIDKeyMatches(validVapidKey, publicKey)
+	ensure.Nil(t, err)
+	ensure.True(t, matches)
+
+	raw, err := base64.RawURLEncoding.DecodeString(publicKey)
+	ensure.Nil(t, err)
+	matches, err = VAPIDKeyMatches(validVapidKey, base64.StdEncoding.EncodeToString(raw))
+	ensure.Nil(t, err)
+	ensure.True(t, matches)
+
+	other, err := ParseVAPIDKey(must(GenerateVAPIDKey()))
+	ensure.Nil(t, err)
+	matches, err = VAPIDKeyMatches(other, publicKey)
+	ensure.Nil(t, err)
+	ensure.False(t, matches)
+
+	_, err = VAPIDKeyMatches(validVapidKey, "{}")
+	ensure.NotNil(t, err)
+}
+
 func TestMakeAuthHeaderHttpsSnapshot(t *testing.T) {
 	cryptotest.SetGlobalRandom(t, 42)
 	header, err := makeAuthHeader(
@@ -148,6 +238,155 @@ func TestMakeAuthHeaderMissingSubscriber(t *testing.T) {
 	ensure.Err(t, err, regexp.MustCompile("invalid subscriber"))
 }
 
+func TestGroupByOrigin(t *testing.T) {
+	google1 := &Subscription{Endpoint: "https://fcm.googleapis.com/fcm/send/a"}
+	google2 := &Subscription{Endpoint: "HTTPS://FCM.googleapis.com/fcm/send/b"}
+	mozilla := &Subscription{Endpoint: "https://updates.push.services.mozilla.com/wpush/v2/c"}
+	malformed := &Subscription{Endpoint: "not a url"}
+	groups := GroupByOrigin([]*Subscription{google1, mozilla, malformed, google2})
+	ensure.DeepEqual(t, groups, map[string][]*Subscription{
+		"https://fcm.googleapis.com":                {google1, google2},
+		"https://updates.push.services.mozilla.com": {mozilla},
+		"": {malformed},
+	})
+}
+
+func BenchmarkMakeAuthHeader(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		_, err := makeAuthHeader(
+			validSubscription.Endpoint,
+			validHTTPSSubscriber,
+			validVapidKey,
+			goldTime,
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestResolveDefaults(t *testing.T) {
+	pinTime(t, goldTime)
+	ensure.DeepEqual(t, (&Client{TTL: time.Hour}).Resolve(), Resolved{
+		RecordSize:      4096,
+		TTL:             time.Hour,
+		VAPIDExpiration: goldTime.Add(12 * time.Hour),
+		UserAgent:       "daaku-webpush",
+	})
+}
+
+func TestResolveCustom(t *testing.T) {
+	client := &Client{
+		TTL:             time.Minute,
+		Topic:           "a-topic",
+		Urgency:         UrgencyHigh,
+		RecordSize:      2048,
+		VAPIDExpiration: goldTime,
+		UserAgent:       "my-app/1.0",
+	}
+	ensure.DeepEqual(t, client.Resolve(), Resolved{
+		RecordSize:      2048,
+		TTL:             time.Minute,
+		Topic:           "a-topic",
+		Urgency:         UrgencyHigh,
+		VAPIDExpiration: goldTime,
+		UserAgent:       "my-app/1.0",
+	})
+}
+
+func TestResolveForVAPIDLifetimes(t *testing.T) {
+	pinTime(t, goldTime)
+	apple := validSubscription
+	apple.Endpoint = "https://web.push.apple.com/capability-url"
+	google := validSubscription
+	google.Endpoint = "https://fcm.googleapis.com/fcm/send/capability-url"
+	client := &Client{
+		VAPIDLifetimes: map[PushService]time.Duration{
+			PushServiceApple:  time.Hour,
+			PushServiceGoogle: 24 * time.Hour,
+		},
+	}
+	ensure.DeepEqual(t, client.ResolveFor(&apple).VAPIDExpiration, goldTime.Add(time.Hour))
+	ensure.DeepEqual(t, client.ResolveFor(&google).VAPIDExpiration, goldTime.Add(24*time.Hour))
+	ensure.DeepEqual(t, client.ResolveFor(&validSubscription).VAPIDExpiration, goldTime.Add(defaultVAPIDLifetime))
+
+	client.VAPIDExpiration = goldTime.Add(time.Minute)
+	ensure.DeepEqual(t, client.ResolveFor(&apple).VAPIDExpiration, goldTime.Add(time.Minute))
+}
+
+func TestSendVAPIDLifetimes(t *testing.T) {
+	pinTime(t, goldTime)
+	var exp any
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				exp = authClaims(t, r)["exp"]
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:       validVapidKey,
+		Subscriber:     validHTTPSSubscriber,
+		TTL:            time.Hour,
+		VAPIDLifetimes: map[PushService]time.Duration{PushServiceApple: time.Hour},
+	}
+	apple := validSubscription
+	apple.Endpoint = "https://web.push.apple.com/capability-url"
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &apple))
+	ensure.DeepEqual(t, exp, float64(goldTime.Add(time.Hour).Unix()))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, exp, float64(goldTime.Add(defaultVAPIDLifetime).Unix()))
+}
+
+func TestVAPIDPublicKey(t *testing.T) {
+	publicKeyBytes, err := validVapidKey.PublicKey.Bytes()
+	ensure.Nil(t, err)
+	expected := base64.RawURLEncoding.EncodeToString(publicKeyBytes)
+	for range 2 {
+		encoded, err := vapidPublicKey(validVapidKey)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, encoded, expected)
+	}
+}
+
+func BenchmarkVAPIDPublicKey(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := vapidPublicKey(validVapidKey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVAPIDPublicKeyUncached(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		publicKeyBytes, err := validVapidKey.PublicKey.Bytes()
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = base64.RawURLEncoding.EncodeToString(publicKeyBytes)
+	}
+}
+
+func TestOverheadConstants(t *testing.T) {
+	ensure.DeepEqual(t, HeaderLen, headerLen)
+	ensure.DeepEqual(t, MinOverhead, minOverhead)
+	ensure.DeepEqual(t, HeaderLen+PaddingLen+TagLen, MinOverhead)
+}
+
+func TestMaxPayload(t *testing.T) {
+	apple := validSubscription
+	apple.Endpoint = "https://web.push.apple.com/capability-url"
+	client := &Client{}
+	ensure.DeepEqual(t, client.MaxPayload(&validSubscription), 4096-minOverhead)
+	ensure.DeepEqual(t, client.MaxPayload(&apple), 4096-minOverhead)
+	client.RecordSize = 8192
+	ensure.DeepEqual(t, client.MaxPayload(&validSubscription), 8192-minOverhead)
+	ensure.DeepEqual(t, client.MaxPayload(&apple), 4096-minOverhead)
+}
+
 func TestSendDefaultsSnapshot(t *testing.T) {
 	cryptotest.SetGlobalRandom(t, 42)
 	client := &Client{
@@ -159,6 +398,7 @@ func TestSendDefaultsSnapshot(t *testing.T) {
 					"Content-Encoding": []string{"aes128gcm"},
 					"Content-Type":     []string{"application/octet-stream"},
 					"Ttl":              []string{"3600"},
+					"User-Agent":       []string{"daaku-webpush"},
 				})
 				body, err := io.ReadAll(r.Body)
 				ensure.Nil(t, err)
@@ -179,6 +419,130 @@ func TestSendDefaultsSnapshot(t *testing.T) {
 	ensure.Nil(t, err)
 }
 
+// Reads the salt from r for the duration of the test.
+func pinSaltReader(t testing.TB, r io.Reader) {
+	original := saltReader
+	saltReader = r
+	t.Cleanup(func() { saltReader = original })
+}
+
+// Reads the salt from the given bytes before falling back to the real source.
+func pinSalt(t testing.TB, salt []byte) {
+	pinSaltReader(t, io.MultiReader(bytes.NewReader(salt), saltReader))
+}
+
+func TestSendRFC8291Vector(t *testing.T) {
+	pinSalt(t, must(base64.RawURLEncoding.DecodeString(rfc8291Salt)))
+	appServerKey := must(ecdh.P256().NewPrivateKey(
+		must(base64.RawURLEncoding.DecodeString(rfc8291AppServerPrivateKey))))
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				ensure.DeepEqual(t, base64.RawURLEncoding.EncodeToString(body), rfc8291Body)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		ECDH: func(userAgentPublicKey *ecdh.PublicKey) ([]byte, []byte, error) {
+			sharedSecret, err := appServerKey.ECDH(userAgentPublicKey)
+			return sharedSecret, appServerKey.PublicKey().Bytes(), err
+		},
+	}
+	err := client.Send(context.Background(), []byte(rfc8291Plaintext), &rfc8291Subscription)
+	ensure.Nil(t, err)
+}
+
+func TestTTLSeconds(t *testing.T) {
+	cases := []struct {
+		ttl     time.Duration
+		seconds int
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{500 * time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 1},
+		{time.Hour, 3600},
+	}
+	for _, c := range cases {
+		t.Run(c.ttl.String(), func(t *testing.T) {
+			ensure.DeepEqual(t, ttlSeconds(c.ttl), c.seconds)
+		})
+	}
+}
+
+func TestSendSubSecondTTL(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ensure.DeepEqual(t, r.Header.Get("TTL"), "1")
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        500 * time.Millisecond,
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &validSubscription))
+}
+
+func TestSendCollapsed(t *testing.T) {
+	var topics []string
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				topics = append(topics, r.Header.Get("Topic"))
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Topic:      "default",
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.SendCollapsed(ctx, []byte("1"), &validSubscription, "user-1:reply"))
+	ensure.Nil(t, client.SendCollapsed(ctx, []byte("2"), &validSubscription, "user-1:reply", WithTopic("other")))
+	ensure.Nil(t, client.SendCollapsed(ctx, []byte("3"), &validSubscription, "user-1:like"))
+	ensure.DeepEqual(t, len(topics), 3)
+	ensure.DeepEqual(t, topics[0], topics[1])
+	ensure.NotDeepEqual(t, topics[0], topics[2])
+	for _, topic := range topics {
+		ensure.DeepEqual(t, len(topic), 32)
+		ensure.True(t, regexp.MustCompile(`^[A-Za-z0-9_-]+$`).MatchString(topic), topic)
+	}
+	ensure.DeepEqual(t, topics[0], TopicFromKey("user-1:reply"))
+	ensure.DeepEqual(t, client.Topic, "default")
+}
+
+func TestSendDeadline(t *testing.T) {
+	pinTime(t, goldTime)
+	var ttl string
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ttl = r.Header.Get("TTL")
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Deadline:   goldTime.Add(90*time.Second + 500*time.Millisecond),
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, ttl, "90")
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription, WithDeadline(goldTime.Add(-time.Minute))))
+	ensure.DeepEqual(t, ttl, "0")
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription, WithDeadline(time.Time{})))
+	ensure.DeepEqual(t, ttl, "3600")
+}
+
 func TestSendTopic(t *testing.T) {
 	const topic = "a-test"
 	client := &Client{
@@ -223,68 +587,1728 @@ func TestSendUrgency(t *testing.T) {
 	ensure.Nil(t, err)
 }
 
-func TestSendErrorTooLongCustomRecordSize(t *testing.T) {
-	err := (&Client{RecordSize: 1}).Send(
-		context.Background(),
-		[]byte("12"),
-		&validSubscription,
-	)
-	ensure.Err(t, err, regexp.MustCompile("too long"))
-}
-
-func TestSendErrorTooLongDefaultRecordSize(t *testing.T) {
-	err := (&Client{}).Send(
-		context.Background(),
-		bytes.Repeat([]byte("1"), maxRecordSize),
-		&validSubscription,
-	)
-	ensure.Err(t, err, regexp.MustCompile("too long"))
+func TestSendRecordNotPadded(t *testing.T) {
+	var records [][]byte
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				records = append(records, body)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("hi"), &validSubscription))
+	ensure.Nil(t, client.Send(ctx, bytes.Repeat([]byte("a"), 1000), &validSubscription))
+	ensure.DeepEqual(t, len(records[0]), minOverhead+2)
+	ensure.DeepEqual(t, len(records[1]), minOverhead+1000)
+	for _, r := range records {
+		ensure.DeepEqual(t, binary.BigEndian.Uint32(r[16:20]), uint32(maxRecordSize))
+	}
 }
 
-func TestSendErrorEmptySubscription(t *testing.T) {
-	err := (&Client{}).Send(
-		context.Background(),
-		[]byte("1"),
-		&Subscription{},
-	)
-	ensure.Err(t, err, regexp.MustCompile("invalid subscription"))
+func TestSendFreshKeyMaterial(t *testing.T) {
+	cryptotest.SetGlobalRandom(t, 42)
+	var records [][]byte
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				records = append(records, body)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	for range 2 {
+		ensure.Nil(t, client.Send(context.Background(), []byte("test"), &validSubscription))
+	}
+	ensure.DeepEqual(t, len(records), 2)
+	// salt
+	ensure.NotDeepEqual(t, records[0][:16], records[1][:16])
+	// application server public key
+	ensure.NotDeepEqual(t, records[0][21:headerLen], records[1][21:headerLen])
 }
 
-func TestSendErrorInvalidAuthSecret(t *testing.T) {
-	sub := validSubscription
-	sub.Keys.Auth = "{}"
-	err := (&Client{}).Send(
-		context.Background(),
-		[]byte("1"),
-		&sub,
-	)
-	ensure.Err(t, err, regexp.MustCompile("invalid encoded auth"))
+func TestPushResult(t *testing.T) {
+	cases := []struct {
+		label    string
+		response *http.Response
+		result   Result
+	}{
+		{"201 without location", &http.Response{StatusCode: http.StatusCreated}, Result{State: StateAccepted, StatusCode: http.StatusCreated}},
+		{"200", &http.Response{StatusCode: http.StatusOK}, Result{State: StateAccepted, StatusCode: http.StatusOK}},
+		{
+			"201 with location",
+			&http.Response{
+				StatusCode: http.StatusCreated,
+				Header:     http.Header{"Location": {"https://the.push.server/message/1"}},
+			},
+			Result{State: StateAccepted, StatusCode: http.StatusCreated, Location: "https://the.push.server/message/1"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			client := &Client{
+				Client: &http.Client{
+					Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+						return c.response, nil
+					}),
+				},
+				VAPIDKey:   validVapidKey,
+				Subscriber: validHTTPSSubscriber,
+			}
+			result, err := client.Push(context.Background(), []byte("test"), &validSubscription)
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, *result, c.result)
+		})
+	}
 }
 
-func TestSendErrorInvalidPublicKey(t *testing.T) {
-	sub := validSubscription
-	sub.Keys.P256dh = "{}"
-	err := (&Client{}).Send(
-		context.Background(),
-		[]byte("1"),
-		&sub,
-	)
-	ensure.Err(t, err, regexp.MustCompile("invalid encoded public key"))
+func TestLinkWithRel(t *testing.T) {
+	const receipt = "https://push.example.net/receipt/XYZ"
+	cases := []struct {
+		label  string
+		values []string
+		target string
+	}{
+		{"simple", []string{`<` + receipt + `>; rel="urn:ietf:params:push:receipt"`}, receipt},
+		{"token rel", []string{`<` + receipt + `>;rel=urn:ietf:params:push:receipt`}, receipt},
+		{
+			"multiple links",
+			[]string{`<https://push.example.net/p/1>; rel="urn:ietf:params:push", <` + receipt + `>; title="a, b"; rel="urn:ietf:params:push:receipt"`},
+			receipt,
+		},
+		{"multiple values", []string{`<https://a.example>; rel=next`, `<` + receipt + `>; rel="other urn:ietf:params:push:receipt"`}, receipt},
+		{"escaped quote", []string{`<` + receipt + `>; title="say \"hi\"; rel=x"; rel="URN:IETF:PARAMS:PUSH:RECEIPT"`}, receipt},
+		{"missing", []string{`<https://a.example>; rel="urn:ietf:params:push"`}, ""},
+		{"relation in title", []string{`<https://a.example>; title="rel=urn:ietf:params:push:receipt"`}, ""},
+		{"malformed", []string{`https://a.example; rel="urn:ietf:params:push:receipt"`}, ""},
+		{"empty", nil, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			ensure.DeepEqual(t, linkWithRel(c.values, receiptRel), c.target)
+		})
+	}
 }
 
-func TestSendErrorInvalidUrgency(t *testing.T) {
+func TestPushDebugKeyMaterial(t *testing.T) {
+	var body []byte
 	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				body = must(io.ReadAll(r.Body))
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
 		VAPIDKey:   validVapidKey,
 		Subscriber: validHTTPSSubscriber,
 		TTL:        time.Hour,
-		Urgency:    Urgency("invalid"),
 	}
-	err := client.Send(
-		context.Background(),
-		[]byte("test"),
-		&validSubscription,
-	)
-	ensure.Err(t, err, regexp.MustCompile("invalid urgency"))
+	ctx := context.Background()
+	result, err := client.Push(ctx, []byte("test"), &validSubscription)
+	ensure.Nil(t, err)
+	ensure.True(t, result.Salt == nil)
+	ensure.True(t, result.AppServerPublicKey == nil)
+
+	client.DebugKeyMaterial = true
+	salts := map[string]bool{}
+	keys := map[string]bool{}
+	for range 10 {
+		result, err := client.Push(ctx, []byte("test"), &validSubscription)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, result.Salt, body[:16])
+		ensure.DeepEqual(t, result.AppServerPublicKey, body[21:headerLen])
+		salts[string(result.Salt)] = true
+		keys[string(result.AppServerPublicKey)] = true
+	}
+	ensure.DeepEqual(t, len(salts), 10)
+	ensure.DeepEqual(t, len(keys), 10)
+}
+
+func TestPushResultAcceptedTTL(t *testing.T) {
+	cases := []struct {
+		header string
+		ttl    *time.Duration
+	}{
+		{"600", new(10 * time.Minute)},
+		{"0", new(time.Duration(0))},
+		{"", nil},
+		{"ten", nil},
+		{"-1", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.header, func(t *testing.T) {
+			client := &Client{
+				Client: &http.Client{
+					Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+						return &http.Response{
+							StatusCode: http.StatusCreated,
+							Header:     http.Header{"Ttl": {c.header}},
+						}, nil
+					}),
+				},
+				VAPIDKey:   validVapidKey,
+				Subscriber: validHTTPSSubscriber,
+				TTL:        time.Hour,
+			}
+			result, err := client.Push(context.Background(), []byte("test"), &validSubscription)
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, result.AcceptedTTL, c.ttl)
+		})
+	}
+}
+
+func TestPushResultReceipt(t *testing.T) {
+	cases := []struct {
+		label, target, receipt string
+	}{
+		{"absolute", "https://push.example.net/receipt/XYZ", "https://push.example.net/receipt/XYZ"},
+		// RFC 8030 section 5.1
+		{
+			"relative",
+			"/receipt-subscription/3ZtI4YVNBnUUZhuoChl6omUvG4ZM",
+			validSubscriptionEndpointOrigin + "/receipt-subscription/3ZtI4YVNBnUUZhuoChl6omUvG4ZM",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			client := &Client{
+				Client: &http.Client{
+					Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+						return &http.Response{
+							StatusCode: http.StatusCreated,
+							Header:     http.Header{"Link": {`<` + c.target + `>; rel="urn:ietf:params:push:receipt"`}},
+						}, nil
+					}),
+				},
+				VAPIDKey:   validVapidKey,
+				Subscriber: validHTTPSSubscriber,
+			}
+			result, err := client.Push(context.Background(), []byte("test"), &validSubscription)
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, result.Receipt, c.receipt)
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	older := validSubscription
+	newer := validSubscription
+	newer.Endpoint = "https://the.push.server/newer"
+	statuses := map[string]int{}
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: statuses[r.URL.String()]}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+
+	statuses[newer.Endpoint] = http.StatusCreated
+	used, result, err := client.Migrate(ctx, []byte("test"), &older, &newer)
+	ensure.Nil(t, err)
+	ensure.True(t, used == &newer)
+	ensure.DeepEqual(t, result.StatusCode, http.StatusCreated)
+
+	statuses[newer.Endpoint] = http.StatusGone
+	statuses[older.Endpoint] = http.StatusCreated
+	used, _, err = client.Migrate(ctx, []byte("test"), &older, &newer)
+	ensure.Nil(t, err)
+	ensure.True(t, used == &older)
+
+	statuses[newer.Endpoint] = http.StatusTooManyRequests
+	_, _, err = client.Migrate(ctx, []byte("test"), &older, &newer)
+	ensure.True(t, errors.Is(err, ErrRateLimited), err)
+}
+
+func TestSendEmpty(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ensure.DeepEqual(t, r.Method, http.MethodPost)
+				ensure.True(t, r.Body == http.NoBody)
+				ensure.DeepEqual(t, r.Header.Get("Content-Encoding"), "")
+				ensure.DeepEqual(t, r.Header.Get("TTL"), "3600")
+				ensure.DeepEqual(t, authClaims(t, r)["aud"], validSubscriptionEndpointOrigin)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ensure.Nil(t, client.SendEmpty(context.Background(), &validSubscription))
+	err := client.SendEmpty(context.Background(), &Subscription{})
+	ensure.Err(t, err, regexp.MustCompile("missing endpoint"))
+}
+
+func TestSendContentLength(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ensure.DeepEqual(t, r.ContentLength, int64(minOverhead+len("test")))
+				var buf bytes.Buffer
+				ensure.Nil(t, r.Write(&buf))
+				head, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+				ensure.DeepEqual(t, int64(len(body)), r.ContentLength)
+				ensure.StringContains(t, head, "\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n")
+				ensure.StringDoesNotContain(t, head, "Transfer-Encoding")
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &validSubscription))
+}
+
+func TestRequestSize(t *testing.T) {
+	pinTime(t, goldTime)
+	var wire int
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				var buf bytes.Buffer
+				ensure.Nil(t, r.Write(&buf))
+				wire = buf.Len()
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Topic:      "news",
+	}
+	ctx := context.Background()
+	message := []byte("test")
+	size, err := client.RequestSize(ctx, message, &validSubscription)
+	ensure.Nil(t, err)
+	ensure.Nil(t, client.Send(ctx, message, &validSubscription))
+	// the signature differs between requests, but not in size
+	ensure.DeepEqual(t, size, wire)
+	ensure.True(t, size > minOverhead+len(message)+200)
+
+	_, err = client.RequestSize(ctx, message, &Subscription{})
+	ensure.Err(t, err, regexp.MustCompile("invalid subscription"))
+}
+
+func TestSendEmptyHeaders(t *testing.T) {
+	var wire []string
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				var buf bytes.Buffer
+				ensure.Nil(t, r.Write(&buf))
+				head, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+				ensure.DeepEqual(t, body, "")
+				wire = strings.Split(head, "\r\n")[1:]
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	hasHeader := func(name string) bool {
+		return slices.ContainsFunc(wire, func(h string) bool {
+			return strings.HasPrefix(strings.ToLower(h), strings.ToLower(name)+":")
+		})
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.SendEmpty(ctx, &validSubscription))
+	ensure.True(t, slices.Contains(wire, "Content-Length: 0"), wire)
+	ensure.False(t, hasHeader("Content-Type"), wire)
+	ensure.False(t, hasHeader("Content-Encoding"), wire)
+
+	client.EmptyContentType = "application/octet-stream"
+	ensure.Nil(t, client.SendEmpty(ctx, &validSubscription))
+	ensure.True(t, slices.Contains(wire, "Content-Type: application/octet-stream"), wire)
+	ensure.True(t, slices.Contains(wire, "Content-Length: 0"), wire)
+}
+
+func TestSendAsync(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	var results []<-chan error
+	for range 50 {
+		results = append(results, client.SendAsync(context.Background(), []byte("test"), &validSubscription))
+	}
+	for _, r := range results {
+		ensure.Nil(t, <-r)
+	}
+}
+
+func TestSendAsyncCancelled(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				if err := r.Context().Err(); err != nil {
+					return nil, err
+				}
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := <-client.SendAsync(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, context.Canceled), err)
+}
+
+func TestSendAsyncPool(t *testing.T) {
+	const size, sends = 2, 10
+	var mu sync.Mutex
+	var inFlight, peak int
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				mu.Lock()
+				inFlight++
+				peak = max(peak, inFlight)
+				mu.Unlock()
+				started <- struct{}{}
+				<-proceed
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		AsyncPool:  &WorkerPool{Size: size},
+	}
+	results := make(chan (<-chan error), sends)
+	go func() {
+		for range sends {
+			results <- client.SendAsync(context.Background(), []byte("test"), &validSubscription)
+		}
+		close(results)
+	}()
+
+	// fill the pool, then let one send complete for every one that starts
+	for range size {
+		<-started
+	}
+	for i := range sends {
+		proceed <- struct{}{}
+		if i < sends-size {
+			<-started
+		}
+	}
+	for r := range results {
+		ensure.Nil(t, <-r)
+	}
+	ensure.DeepEqual(t, peak, size)
+
+	// a cancelled context is delivered while waiting for a slot
+	pool := &WorkerPool{Size: 1}
+	ensure.Nil(t, pool.acquire(context.Background()))
+	client.AsyncPool = pool
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := <-client.SendAsync(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, context.Canceled), err)
+}
+
+type countingReader struct {
+	r     io.Reader
+	calls int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.calls++
+	return c.r.Read(p)
+}
+
+func TestSendCancelledBeforeEncryption(t *testing.T) {
+	counter := &countingReader{r: saltReader}
+	pinSaltReader(t, counter)
+
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				t.Fatal("unexpected request")
+				return nil, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, context.Canceled), err)
+	err = client.SendEmpty(ctx, &validSubscription)
+	ensure.True(t, errors.Is(err, context.Canceled), err)
+	ensure.DeepEqual(t, counter.calls, 0)
+}
+
+func TestSendPrefer(t *testing.T) {
+	var prefer []string
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				prefer = append(prefer, r.Header.Values("Prefer")...)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(prefer), 0)
+	client.Prefer = "respond-async"
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, prefer, []string{"respond-async"})
+}
+
+func TestSendErrorInvalidPrefer(t *testing.T) {
+	client := &Client{
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Prefer:     "wait=10",
+	}
+	err := client.Send(context.Background(), []byte("test"), &validSubscription)
+	ensure.Err(t, err, regexp.MustCompile("invalid prefer"))
+}
+
+func TestSendUserAgent(t *testing.T) {
+	const userAgent = "my-app/1.0"
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ensure.DeepEqual(t, r.Header.Get("User-Agent"), userAgent)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		UserAgent:  userAgent,
+	}
+	err := client.Send(
+		context.Background(),
+		[]byte("test"),
+		&validSubscription,
+	)
+	ensure.Nil(t, err)
+}
+
+func TestSendWithSubscriber(t *testing.T) {
+	const tenant = "mailto:tenant@app.server"
+	var subs []any
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				subs = append(subs, authClaims(t, r)["sub"])
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription, WithSubscriber(tenant)))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, subs, []any{tenant, validHTTPSSubscriber})
+	ensure.DeepEqual(t, client.Subscriber, validHTTPSSubscriber)
+}
+
+func TestSendOptionsDoNotPersist(t *testing.T) {
+	var headers []http.Header
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				headers = append(headers, r.Header)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Topic:      "default",
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription,
+		WithTopic("x"), WithUrgency(UrgencyHigh), WithTTL(time.Minute)))
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+
+	ensure.DeepEqual(t, headers[0].Get("Topic"), "x")
+	ensure.DeepEqual(t, headers[0].Get("Urgency"), "high")
+	ensure.DeepEqual(t, headers[0].Get("TTL"), "60")
+	ensure.DeepEqual(t, headers[1].Get("Topic"), "default")
+	ensure.DeepEqual(t, headers[1].Get("Urgency"), "")
+	ensure.DeepEqual(t, headers[1].Get("TTL"), "3600")
+}
+
+func TestSendErrorWithInvalidSubscriber(t *testing.T) {
+	client := &Client{
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	err := client.Send(
+		context.Background(),
+		[]byte("test"),
+		&validSubscription,
+		WithSubscriber("admin@app.server"),
+	)
+	ensure.Err(t, err, regexp.MustCompile("invalid subscriber"))
+}
+
+func TestSendOnDuration(t *testing.T) {
+	cases := []struct {
+		label  string
+		status int
+		err    error
+	}{
+		{"created", http.StatusCreated, nil},
+		{"gone", http.StatusGone, nil},
+		{"transport error", 0, errors.New("connection refused")},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			var calls int
+			client := &Client{
+				Client: &http.Client{
+					Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+						time.Sleep(time.Millisecond)
+						if c.err != nil {
+							return nil, c.err
+						}
+						return &http.Response{StatusCode: c.status}, nil
+					}),
+				},
+				VAPIDKey:   validVapidKey,
+				Subscriber: validHTTPSSubscriber,
+				TTL:        time.Hour,
+				OnDuration: func(d time.Duration, status int) {
+					calls++
+					ensure.True(t, d >= time.Millisecond, d)
+					ensure.DeepEqual(t, status, c.status)
+				},
+			}
+			_ = client.Send(context.Background(), []byte("test"), &validSubscription)
+			ensure.DeepEqual(t, calls, 1)
+		})
+	}
+}
+
+func TestSendEndpointRewrite(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ensure.DeepEqual(t, r.URL.String(), "https://mirror.example/capability-url")
+				ensure.DeepEqual(t, authClaims(t, r)["aud"], validSubscriptionEndpointOrigin)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		EndpointRewrite: func(endpoint string) string {
+			return strings.Replace(endpoint, "the.push.server", "mirror.example", 1)
+		},
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &validSubscription))
+}
+
+func TestSendCustomECDH(t *testing.T) {
+	appServerKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	ensure.Nil(t, err)
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				ensure.DeepEqual(t, body[21:headerLen], appServerKey.PublicKey().Bytes())
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		ECDH: func(userAgentPublicKey *ecdh.PublicKey) ([]byte, []byte, error) {
+			ensure.DeepEqual(t,
+				base64.RawURLEncoding.EncodeToString(userAgentPublicKey.Bytes()),
+				validSubscription.Keys.P256dh)
+			sharedSecret, err := appServerKey.ECDH(userAgentPublicKey)
+			return sharedSecret, appServerKey.PublicKey().Bytes(), err
+		},
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &validSubscription))
+}
+
+func TestSendErrorCustomECDH(t *testing.T) {
+	client := &Client{
+		ECDH: func(*ecdh.PublicKey) ([]byte, []byte, error) {
+			return nil, nil, errors.New("hsm unavailable")
+		},
+	}
+	err := client.Send(context.Background(), []byte("test"), &validSubscription)
+	ensure.Err(t, err, regexp.MustCompile("failed to derive shared secret: hsm unavailable"))
+
+	client.ECDH = func(*ecdh.PublicKey) ([]byte, []byte, error) {
+		return make([]byte, 32), make([]byte, 33), nil
+	}
+	err = client.Send(context.Background(), []byte("test"), &validSubscription)
+	ensure.Err(t, err, regexp.MustCompile("invalid application server public key length of 33"))
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSendAndForget(t *testing.T) {
+	body := &closeRecorder{Reader: strings.NewReader("gone")}
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusGone, Body: body}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ensure.Nil(t, client.SendAndForget(context.Background(), []byte("test"), &validSubscription))
+	ensure.True(t, body.closed)
+}
+
+func TestSendAndForgetTransportError(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	err := client.SendAndForget(context.Background(), []byte("test"), &validSubscription)
+	ensure.Err(t, err, regexp.MustCompile("connection refused"))
+}
+
+func TestSendVAPIDHeader(t *testing.T) {
+	var headers []string
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				headers = append(headers, r.Header.Get("Authorization"))
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:        validVapidKey,
+		Subscriber:      validHTTPSSubscriber,
+		TTL:             time.Hour,
+		VAPIDExpiration: goldTime,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	client.VAPIDHeader = func(token, publicKey string) string {
+		return "WebPush " + token + ";k=" + publicKey
+	}
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+
+	token, publicKey, ok := strings.Cut(strings.TrimPrefix(headers[0], "vapid t="), ", k=")
+	ensure.True(t, ok, headers[0])
+	ensure.DeepEqual(t, publicKey, "BBRS0hDoszIXnLVNyR3EbnXnN4glsvb6AusPR9e9L93ZWHeKO4mYTWjpwa5w2xwc0sZBIBIQ-RtwDgE7BZqRWc0")
+	ensure.True(t, strings.HasPrefix(headers[1], "WebPush "), headers[1])
+	ensure.True(t, strings.HasSuffix(headers[1], ";k="+publicKey), headers[1])
+	ensure.DeepEqual(t, strings.Count(token, "."), 2)
+}
+
+func TestSendSignVAPID(t *testing.T) {
+	pinTime(t, goldTime)
+	var header string
+	var signed map[string]any
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				header = r.Header.Get("Authorization")
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		SignVAPID: func(claims map[string]any) (string, error) {
+			signed = claims
+			return "header.payload.signature", nil
+		},
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, signed, map[string]any{
+		"aud": validSubscriptionEndpointOrigin,
+		"exp": goldTime.Add(defaultVAPIDLifetime).Unix(),
+		"sub": validHTTPSSubscriber,
+	})
+	ensure.True(t, strings.HasPrefix(header, "vapid t=header.payload.signature, k="), header)
+
+	client.SignVAPID = func(map[string]any) (string, error) {
+		return "", errors.New("hsm unavailable")
+	}
+	err := client.Send(context.Background(), []byte("test"), &validSubscription)
+	ensure.Err(t, err, regexp.MustCompile("hsm unavailable"))
+}
+
+func TestTokenExpiry(t *testing.T) {
+	pinTime(t, goldTime)
+	var req *http.Request
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				req = r
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	exp, ok := TokenExpiry(req)
+	ensure.True(t, ok)
+	ensure.True(t, exp.Equal(goldTime.Add(defaultVAPIDLifetime)), exp)
+
+	client.VAPIDExpiration = goldTime.Add(time.Hour + 500*time.Millisecond)
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	exp, ok = TokenExpiry(req)
+	ensure.True(t, ok)
+	ensure.True(t, exp.Equal(goldTime.Add(time.Hour)), exp)
+
+	for _, header := range []string{"", "Bearer abc", "vapid k=abc", "vapid t=not.a.jwt, k=abc"} {
+		r := &http.Request{Header: http.Header{"Authorization": {header}}}
+		_, ok := TokenExpiry(r)
+		ensure.False(t, ok, header)
+	}
+}
+
+func TestSendClockSkewTolerance(t *testing.T) {
+	pinTime(t, goldTime)
+	var claims jwt.MapClaims
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				claims = authClaims(t, r)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, claims["exp"], float64(goldTime.Add(defaultVAPIDLifetime).Unix()))
+	_, ok := claims["iat"]
+	ensure.False(t, ok)
+
+	client.ClockSkewTolerance = 5 * time.Minute
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, claims["exp"], float64(goldTime.Add(defaultVAPIDLifetime+5*time.Minute).Unix()))
+	ensure.DeepEqual(t, claims["iat"], float64(goldTime.Add(-5*time.Minute).Unix()))
+}
+
+func TestSendResyncClockOn401(t *testing.T) {
+	pinTime(t, goldTime)
+	serverTime := goldTime.Add(2 * time.Hour)
+	var claims []jwt.MapClaims
+	var bodies [][]byte
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				claims = append(claims, authClaims(t, r))
+				bodies = append(bodies, must(io.ReadAll(r.Body)))
+				if claims[len(claims)-1]["exp"].(float64) < float64(serverTime.Add(defaultVAPIDLifetime).Unix()) {
+					return &http.Response{
+						StatusCode: http.StatusUnauthorized,
+						Header:     http.Header{"Date": {serverTime.Format(http.TimeFormat)}},
+						Body:       io.NopCloser(strings.NewReader("")),
+					}, nil
+				}
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:           validVapidKey,
+		Subscriber:         validHTTPSSubscriber,
+		TTL:                time.Hour,
+		ClockSkewTolerance: time.Minute,
+		TokenCache:         &TokenCache{},
+	}
+	ctx := context.Background()
+	err := client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, ErrVAPIDRejected))
+	ensure.DeepEqual(t, len(claims), 1)
+
+	claims, bodies = nil, nil
+	client.ResyncClockOn401 = true
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(claims), 2)
+	ensure.DeepEqual(t, claims[0]["exp"], float64(goldTime.Add(defaultVAPIDLifetime+time.Minute).Unix()))
+	ensure.DeepEqual(t, claims[1]["exp"], float64(serverTime.Add(defaultVAPIDLifetime+time.Minute).Unix()))
+	ensure.DeepEqual(t, claims[1]["iat"], float64(serverTime.Add(-time.Minute).Unix()))
+	ensure.DeepEqual(t, bodies[1], bodies[0])
+
+	// the resynced token replaces the rejected one in the cache
+	claims = nil
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(claims), 1)
+	ensure.DeepEqual(t, claims[0]["exp"], float64(serverTime.Add(defaultVAPIDLifetime+time.Minute).Unix()))
+
+	// and the offset is used when the token is refreshed
+	later := goldTime.Add(defaultVAPIDLifetime)
+	pinTime(t, later)
+	claims = nil
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, len(claims), 1)
+	ensure.DeepEqual(t, claims[0]["iat"], float64(later.Add(2*time.Hour-time.Minute).Unix()))
+
+	// requests without a body are also retried
+	pinTime(t, goldTime)
+	client.TokenCache = nil
+	claims, bodies = nil, nil
+	ensure.Nil(t, client.SendEmpty(ctx, &validSubscription))
+	ensure.DeepEqual(t, len(claims), 2)
+	ensure.DeepEqual(t, claims[1]["exp"], float64(serverTime.Add(defaultVAPIDLifetime+time.Minute).Unix()))
+	ensure.DeepEqual(t, len(bodies[1]), 0)
+
+	// without a Date header the 401 is returned as is
+	client.Client.Transport = transportFunc(func(r *http.Request) (*http.Response, error) {
+		claims = append(claims, authClaims(t, r))
+		return &http.Response{StatusCode: http.StatusUnauthorized, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})
+	claims = nil
+	err = client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, ErrVAPIDRejected))
+	ensure.DeepEqual(t, len(claims), 1)
+}
+
+func TestSendOnAttempt(t *testing.T) {
+	pinTime(t, goldTime)
+	type attempt struct {
+		attempt, status int
+		err             bool
+	}
+	var attempts []attempt
+	var requests int
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				requests++
+				switch requests {
+				case 1:
+					return &http.Response{
+						StatusCode: http.StatusUnauthorized,
+						Header:     http.Header{"Date": {goldTime.Add(time.Hour).Format(http.TimeFormat)}},
+						Body:       io.NopCloser(strings.NewReader("")),
+					}, nil
+				case 2:
+					return &http.Response{StatusCode: http.StatusCreated}, nil
+				}
+				return nil, errors.New("connection reset")
+			}),
+		},
+		VAPIDKey:         validVapidKey,
+		Subscriber:       validHTTPSSubscriber,
+		TTL:              time.Hour,
+		ResyncClockOn401: true,
+		OnAttempt: func(n, status int, err error) {
+			attempts = append(attempts, attempt{n, status, err != nil})
+		},
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.NotNil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, attempts, []attempt{
+		{1, http.StatusUnauthorized, false},
+		{2, http.StatusCreated, false},
+		{1, 0, true},
+	})
+}
+
+func TestSendSubscribers(t *testing.T) {
+	var sub any
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				sub = authClaims(t, r)["sub"]
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:    validVapidKey,
+		Subscribers: []string{"", "admin@example.com", "mailto:admin@example.com"},
+		TTL:         time.Hour,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, sub, "mailto:admin@example.com")
+
+	client.Subscriber = validHTTPSSubscriber
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, sub, validHTTPSSubscriber)
+
+	client.Subscriber = ""
+	client.Subscribers = []string{"", "admin@example.com"}
+	err := client.Send(ctx, []byte("test"), &validSubscription)
+	ensure.Err(t, err, regexp.MustCompile("invalid subscriber"))
+}
+
+func TestSendErrorTooLongCustomRecordSize(t *testing.T) {
+	err := (&Client{RecordSize: 1}).Send(
+		context.Background(),
+		[]byte("12"),
+		&validSubscription,
+	)
+	ensure.Err(t, err, regexp.MustCompile("too long"))
+}
+
+func TestSendErrorTooLongDefaultRecordSize(t *testing.T) {
+	err := (&Client{}).Send(
+		context.Background(),
+		bytes.Repeat([]byte("1"), maxRecordSize),
+		&validSubscription,
+	)
+	ensure.Err(t, err, regexp.MustCompile("too long"))
+}
+
+func TestSendMaxPayloadBoundary(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	var record []byte
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				var err error
+				record, err = io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+	// RFC 8291 section 4 limits the plaintext to 3993 bytes, so the entire
+	// body including the header fits in 4096 bytes.
+	maxPayload := client.MaxPayload(&rfc8291Subscription)
+	ensure.DeepEqual(t, maxPayload, 3993)
+	message := bytes.Repeat([]byte("1"), maxPayload)
+	ensure.Nil(t, client.Send(ctx, message, &rfc8291Subscription))
+	ensure.DeepEqual(t, len(record), maxRecordSize)
+	ensure.DeepEqual(t, must(Decrypt(record, privateKey, authSecret)), message)
+
+	err := client.Send(ctx, append(message, '1'), &rfc8291Subscription)
+	ensure.Err(t, err, regexp.MustCompile("message length of 3994 is too long"))
+
+	// the Compress flag byte reduces the payload of incompressible messages
+	client.Compress = true
+	maxPayload = client.MaxPayload(&rfc8291Subscription)
+	ensure.DeepEqual(t, maxPayload, 3992)
+	message = make([]byte, maxPayload+1)
+	_, err = rand.Read(message)
+	ensure.Nil(t, err)
+	ensure.Nil(t, client.Send(ctx, message[:maxPayload], &rfc8291Subscription))
+	ensure.DeepEqual(t, len(record), maxRecordSize)
+	ensure.DeepEqual(t, must(Decrypt(record, privateKey, authSecret))[1:], message[:maxPayload])
+	err = client.Send(ctx, message, &rfc8291Subscription)
+	ensure.Err(t, err, regexp.MustCompile("message length of 3993 is too long"))
+}
+
+func TestSendAppleClampsRecordSize(t *testing.T) {
+	sub := validSubscription
+	sub.Endpoint = "https://web.push.apple.com/capability-url"
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				ensure.DeepEqual(t, binary.BigEndian.Uint32(body[16:20]), uint32(maxRecordSize))
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		RecordSize: 8192,
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &sub))
+}
+
+func TestSendErrorAppleStrictRecordSize(t *testing.T) {
+	sub := validSubscription
+	sub.Endpoint = "https://web.push.apple.com/capability-url"
+	err := (&Client{RecordSize: 8192, StrictRecordSize: true}).Send(
+		context.Background(),
+		[]byte("1"),
+		&sub,
+	)
+	ensure.Err(t, err, regexp.MustCompile("record size 8192 exceeds Apple's 4096 limit"))
+}
+
+func TestSendEnvelope(t *testing.T) {
+	header := []byte("envelope:")
+	var recordLen int
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				recordLen = len(body)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Envelope: func(message []byte) ([]byte, error) {
+			return slices.Concat(header, message), nil
+		},
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.DeepEqual(t, recordLen, minOverhead+len(header)+len("test"))
+
+	// fits without the envelope, but not with it
+	message := bytes.Repeat([]byte("1"), maxRecordSize-minOverhead)
+	err := client.Send(ctx, message, &validSubscription)
+	ensure.Err(t, err, regexp.MustCompile("message length of 4002 is too long"))
+}
+
+func TestSendRecordSink(t *testing.T) {
+	pinTime(t, goldTime)
+	var sent [][]byte
+	var sink bytes.Buffer
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				body, err := io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				sent = append(sent, body)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		RecordSink: &sink,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("first"), &validSubscription))
+	ensure.Nil(t, client.SendAndForget(ctx, []byte("second"), &validSubscription))
+
+	dec := json.NewDecoder(&sink)
+	for _, body := range sent {
+		var entry archivedRecord
+		ensure.Nil(t, dec.Decode(&entry))
+		ensure.DeepEqual(t, entry, archivedRecord{
+			Endpoint: validSubscription.Endpoint,
+			Time:     goldTime,
+			Record:   body,
+		})
+	}
+	ensure.False(t, dec.More())
+}
+
+func TestShouldCompress(t *testing.T) {
+	repetitive := bytes.Repeat([]byte(`{"title":"hello","body":"world"}`), 100)
+	random := make([]byte, 3000)
+	_, err := rand.Read(random)
+	ensure.Nil(t, err)
+	compressed := must(gzipMessage(repetitive))
+
+	ensure.True(t, ShouldCompress(repetitive, 0))
+	ensure.True(t, ShouldCompress(repetitive[:2000], 0))
+	ensure.False(t, ShouldCompress(repetitive[:1000], 0))
+	ensure.True(t, ShouldCompress(repetitive[:1000], 2048))
+	ensure.False(t, ShouldCompress([]byte("hi"), 0))
+	ensure.False(t, ShouldCompress(random, 0))
+	ensure.False(t, ShouldCompress(append(compressed, repetitive...), 0))
+}
+
+func TestSendCompress(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	var record []byte
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				var err error
+				record, err = io.ReadAll(r.Body)
+				ensure.Nil(t, err)
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+	message := bytes.Repeat([]byte(`{"title":"hello"}`), 500)
+	err := client.Send(ctx, message, &rfc8291Subscription)
+	ensure.Err(t, err, regexp.MustCompile("is too long"))
+
+	client.Compress = true
+	ensure.Nil(t, client.Send(ctx, message, &rfc8291Subscription))
+	plaintext, err := Decrypt(record, privateKey, authSecret)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, plaintext[0], CompressedGzip)
+	r, err := gzip.NewReader(bytes.NewReader(plaintext[1:]))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, must(io.ReadAll(r)), message)
+
+	// flagged as sent as is when compression is not recommended
+	ensure.Nil(t, client.Send(ctx, []byte("hi"), &rfc8291Subscription))
+	plaintext, err = Decrypt(record, privateKey, authSecret)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, plaintext, []byte("\x00hi"))
+
+	// without Compress there is no flag
+	client.Compress = false
+	ensure.Nil(t, client.Send(ctx, []byte("hi"), &rfc8291Subscription))
+	plaintext, err = Decrypt(record, privateKey, authSecret)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(plaintext), "hi")
+}
+
+func TestSendErrorEnvelope(t *testing.T) {
+	client := &Client{
+		Envelope: func([]byte) ([]byte, error) {
+			return nil, errors.New("signing failed")
+		},
+	}
+	err := client.Send(context.Background(), []byte("test"), &validSubscription)
+	ensure.Err(t, err, regexp.MustCompile("failed to envelope message: signing failed"))
+}
+
+func TestSendRecordTransform(t *testing.T) {
+	privateKey, authSecret := rfc8291Keys(t)
+	var body []byte
+	var contentLength int64
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				contentLength = r.ContentLength
+				body = must(io.ReadAll(r.Body))
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Envelope: func(message []byte) ([]byte, error) {
+			return append([]byte("env:"), message...), nil
+		},
+		RecordTransform: func(record []byte) ([]byte, error) {
+			return append(record, "marker"...), nil
+		},
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &rfc8291Subscription))
+	ensure.DeepEqual(t, contentLength, int64(len(body)))
+	ensure.DeepEqual(t, len(body), minOverhead+len("env:test")+len("marker"))
+	record, found := bytes.CutSuffix(body, []byte("marker"))
+	ensure.True(t, found)
+	plaintext, err := Decrypt(record, privateKey, authSecret)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(plaintext), "env:test")
+
+	client.RecordTransform = func([]byte) ([]byte, error) {
+		return nil, errors.New("framing failed")
+	}
+	err = client.Send(context.Background(), []byte("test"), &rfc8291Subscription)
+	ensure.Err(t, err, regexp.MustCompile("failed to transform record: framing failed"))
+}
+
+func TestSendErrorEmptySubscription(t *testing.T) {
+	err := (&Client{}).Send(
+		context.Background(),
+		[]byte("1"),
+		&Subscription{},
+	)
+	ensure.Err(t, err, regexp.MustCompile("invalid subscription"))
+}
+
+func TestSendErrorInvalidAuthSecret(t *testing.T) {
+	sub := validSubscription
+	sub.Keys.Auth = "{}"
+	err := (&Client{}).Send(
+		context.Background(),
+		[]byte("1"),
+		&sub,
+	)
+	ensure.Err(t, err, regexp.MustCompile("invalid encoded auth"))
+}
+
+func TestSendErrorInvalidPublicKey(t *testing.T) {
+	sub := validSubscription
+	sub.Keys.P256dh = "{}"
+	err := (&Client{}).Send(
+		context.Background(),
+		[]byte("1"),
+		&sub,
+	)
+	ensure.Err(t, err, regexp.MustCompile("invalid encoded public key"))
+}
+
+func TestSendErrorInvalidUrgency(t *testing.T) {
+	client := &Client{
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+		Urgency:    Urgency("invalid"),
+	}
+	err := client.Send(
+		context.Background(),
+		[]byte("test"),
+		&validSubscription,
+	)
+	ensure.Err(t, err, regexp.MustCompile("invalid urgency"))
+}
+
+func TestNewErrorGoogleJSON(t *testing.T) {
+	body := []byte(`{"error":{"code":403,"message":"invalid key","status":"PERMISSION_DENIED"}}`)
+	res := &http.Response{StatusCode: http.StatusForbidden}
+	err := newError(validSubscription.Endpoint, res, body)
+	ensure.DeepEqual(t, err.Code, 403)
+	ensure.DeepEqual(t, err.Message, "invalid key")
+	ensure.DeepEqual(t, err.Status, "PERMISSION_DENIED")
+	ensure.DeepEqual(t, err.Body, body)
+}
+
+func TestNewErrorMozillaJSON(t *testing.T) {
+	body := []byte(`{"code":410,"errno":106,"error":"Gone","message":"push subscription has unsubscribed or expired."}`)
+	res := &http.Response{StatusCode: http.StatusGone}
+	err := newError(validSubscription.Endpoint, res, body)
+	ensure.DeepEqual(t, err.Code, 410)
+	ensure.DeepEqual(t, err.Message, "push subscription has unsubscribed or expired.")
+	ensure.DeepEqual(t, err.Status, "Gone")
+	ensure.True(t, err.Permanent)
+}
+
+func TestNewErrorNotJSON(t *testing.T) {
+	body := []byte("<html>bad gateway</html>")
+	res := &http.Response{StatusCode: http.StatusBadGateway}
+	err := newError(validSubscription.Endpoint, res, body)
+	ensure.DeepEqual(t, err.Code, 0)
+	ensure.DeepEqual(t, err.Status, "")
+	ensure.DeepEqual(t, err.Message, "error from push endpoint with status=502")
+	ensure.DeepEqual(t, err.Body, body)
+}
+
+func TestSubscriptionJSONRoundTrip(t *testing.T) {
+	cases := []struct {
+		label string
+		json  string
+	}{
+		{"null expiration", `{"endpoint":"https://the.push.server/capability-url","expirationTime":null,"keys":{"p256dh":"BOaRpSCtjsB92YouZnj8iNgCdFDNVNbid40AGxLcR47DI1S-zQkYf1CDG2G4y9GXeg74-8U_mEMzSZc-mRF_X0Y","auth":"RW2wUiDEKNzSyDxlg7ArbQ"}}`},
+		{"with expiration", `{"endpoint":"https://the.push.server/capability-url","expirationTime":1431486900000,"keys":{"p256dh":"BOaRpSCtjsB92YouZnj8iNgCdFDNVNbid40AGxLcR47DI1S-zQkYf1CDG2G4y9GXeg74-8U_mEMzSZc-mRF_X0Y","auth":"RW2wUiDEKNzSyDxlg7ArbQ"}}`},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			var sub Subscription
+			ensure.Nil(t, json.Unmarshal([]byte(c.json), &sub))
+			out, err := json.Marshal(&sub)
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, string(out), c.json)
+		})
+	}
+}
+
+func TestSubscriptionTag(t *testing.T) {
+	sub := validSubscription
+	sub.Tag = "vapid-2024"
+	out, err := json.Marshal(&sub)
+	ensure.Nil(t, err)
+	var decoded Subscription
+	ensure.Nil(t, json.Unmarshal(out, &decoded))
+	ensure.DeepEqual(t, decoded, sub)
+
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				ensure.DeepEqual(t, r.URL.String(), validSubscription.Endpoint)
+				for _, values := range r.Header {
+					for _, v := range values {
+						ensure.StringDoesNotContain(t, v, sub.Tag)
+					}
+				}
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), &sub))
+}
+
+func TestSubscriptionValidate(t *testing.T) {
+	ensure.Nil(t, validSubscription.Validate())
+
+	cases := []struct {
+		label  string
+		modify func(*Subscription)
+		err    string
+	}{
+		{"empty endpoint", func(s *Subscription) { s.Endpoint = "" }, "invalid endpoint"},
+		{"http endpoint", func(s *Subscription) { s.Endpoint = "http://the.push.server/" }, "not https"},
+		{"bad auth encoding", func(s *Subscription) { s.Keys.Auth = "{}" }, "invalid encoded auth"},
+		{"short auth", func(s *Subscription) { s.Keys.Auth = "RW2wUiDEKNzSyDxl" }, "invalid auth length"},
+		{"bad key encoding", func(s *Subscription) { s.Keys.P256dh = "{}" }, "invalid encoded public key"},
+		{"short key", func(s *Subscription) { s.Keys.P256dh = "BOaRpSCtjsB92YouZnj8iNgCdFDNVNbid40AGxLcR47D" }, "invalid user agent public key"},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			sub := validSubscription
+			c.modify(&sub)
+			ensure.Err(t, sub.Validate(), regexp.MustCompile(c.err))
+		})
+	}
+}
+
+func TestSubscriptionKeyInfo(t *testing.T) {
+	cases := []struct {
+		label              string
+		modify             func(*Subscription)
+		authLen, p256dhLen int
+		valid              bool
+	}{
+		{"standard", func(*Subscription) {}, 16, 65, true},
+		{"short auth", func(s *Subscription) { s.Keys.Auth = "RW2wUiDEKNzSyDxl" }, 12, 65, false},
+		{"short key", func(s *Subscription) { s.Keys.P256dh = "BOaRpSCtjsB92YouZnj8iNgCdFDNVNbid40AGxLcR47D" }, 16, 33, false},
+		{"bad encoding", func(s *Subscription) { s.Keys.Auth = "{}" }, -1, 65, false},
+		{"empty", func(s *Subscription) { s.Keys = Keys{} }, 0, 0, false},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			sub := validSubscription
+			c.modify(&sub)
+			authLen, p256dhLen, valid := sub.KeyInfo()
+			ensure.DeepEqual(t, authLen, c.authLen)
+			ensure.DeepEqual(t, p256dhLen, c.p256dhLen)
+			ensure.DeepEqual(t, valid, c.valid)
+		})
+	}
+}
+
+func TestSubscriptionOriginIn(t *testing.T) {
+	cases := []struct {
+		endpoint string
+		origins  []string
+		in       bool
+	}{
+		{validSubscription.Endpoint, []string{validSubscriptionEndpointOrigin}, true},
+		{validSubscription.Endpoint, []string{"https://other.push.server", validSubscriptionEndpointOrigin + "/"}, true},
+		{"https://The.Push.Server/capability-url", []string{validSubscriptionEndpointOrigin}, true},
+		{validSubscription.Endpoint, []string{"https://other.push.server"}, false},
+		{validSubscription.Endpoint, []string{"http://the.push.server"}, false},
+		{validSubscription.Endpoint, []string{"https://the.push.server:8443"}, false},
+		{validSubscription.Endpoint, nil, false},
+		{"", []string{""}, false},
+	}
+	for _, c := range cases {
+		s := Subscription{Endpoint: c.endpoint}
+		ensure.DeepEqual(t, s.OriginIn(c.origins...), c.in, c.endpoint, c.origins)
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	compact, err := validSubscription.Compact()
+	ensure.Nil(t, err)
+	ensure.False(t, strings.ContainsAny(compact, "+/="))
+	s, err := ParseCompact(compact)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, *s, validSubscription)
+}
+
+func TestCompactErrors(t *testing.T) {
+	_, err := (&Subscription{Endpoint: "https://the.push.server/"}).Compact()
+	ensure.Err(t, err, regexp.MustCompile("invalid auth length"))
+	_, err = ParseCompact("not base64!")
+	ensure.Err(t, err, regexp.MustCompile("invalid encoded compact subscription"))
+	_, err = ParseCompact("AAAA")
+	ensure.Err(t, err, regexp.MustCompile("too short"))
+	compact, err := validSubscription.Compact()
+	ensure.Nil(t, err)
+	_, err = ParseCompact("AAAA" + compact[4:])
+	ensure.Err(t, err, regexp.MustCompile("invalid user agent public key"))
+}
+
+func TestFieldsRoundTrip(t *testing.T) {
+	fields := validSubscription.Fields()
+	ensure.DeepEqual(t, fields, map[string]string{
+		"endpoint": validSubscription.Endpoint,
+		"auth":     validSubscription.Keys.Auth,
+		"p256dh":   validSubscription.Keys.P256dh,
+	})
+	s, err := SubscriptionFromFields(fields)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, *s, validSubscription)
+
+	full := validSubscription
+	full.ExpirationTime = new(int64(1700000000000))
+	full.Tag = "key-1"
+	s, err = SubscriptionFromFields(full.Fields())
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, *s, full)
+}
+
+func TestSubscriptionFromFieldsErrors(t *testing.T) {
+	_, err := SubscriptionFromFields(map[string]string{"endpoint": validSubscription.Endpoint})
+	ensure.Err(t, err, regexp.MustCompile("missing endpoint or keys"))
+	fields := validSubscription.Fields()
+	fields["expirationTime"] = "soon"
+	_, err = SubscriptionFromFields(fields)
+	ensure.Err(t, err, regexp.MustCompile("invalid expiration time"))
+}
+
+func TestSubscriptionFromGCM(t *testing.T) {
+	const registrationID = "APA91bHun4MxP5egoKMwt2KZFBaFUH-1RYqx"
+	s, err := SubscriptionFromGCM(registrationID, validSubscription.Keys)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, s.Endpoint, "https://fcm.googleapis.com/fcm/send/"+registrationID)
+	ensure.DeepEqual(t, s.Keys, validSubscription.Keys)
+	ensure.Nil(t, s.Validate())
+	ensure.DeepEqual(t, DetectPushService(s.Endpoint), PushServiceGoogle)
+
+	var endpoint string
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				endpoint = r.URL.String()
+				return &http.Response{StatusCode: http.StatusCreated}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ensure.Nil(t, client.Send(context.Background(), []byte("test"), s))
+	ensure.DeepEqual(t, endpoint, s.Endpoint)
+
+	_, err = SubscriptionFromGCM("", validSubscription.Keys)
+	ensure.Err(t, err, regexp.MustCompile("missing gcm registration id"))
+	_, err = SubscriptionFromGCM("https://android.googleapis.com/gcm/send/"+registrationID, validSubscription.Keys)
+	ensure.Err(t, err, regexp.MustCompile("invalid gcm registration id"))
+}
+
+func TestPartitionValid(t *testing.T) {
+	insecure := validSubscription
+	insecure.Endpoint = "http://the.push.server/capability-url"
+	shortKey := validSubscription
+	shortKey.Keys.P256dh = "BOaRpSCtjsB92YouZnj8iNgCdFDNVNbid40AGxLcR47D"
+	other := validSubscription
+	other.Endpoint = "https://the.push.server/other"
+
+	valid, invalid := PartitionValid([]*Subscription{&validSubscription, &insecure, &other, &shortKey})
+	ensure.DeepEqual(t, valid, []*Subscription{&validSubscription, &other})
+	ensure.DeepEqual(t, invalid, []*Subscription{&insecure, &shortKey})
+}
+
+func TestSendErrorGzipBody(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write([]byte(`{"reason":"BadJwtToken"}`))
+	ensure.Nil(t, err)
+	ensure.Nil(t, gz.Close())
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusForbidden,
+					Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+					Body:       io.NopCloser(bytes.NewReader(compressed.Bytes())),
+				}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	err = client.Send(context.Background(), []byte("test"), &validSubscription)
+	pushErr, ok := errors.AsType[*Error](err)
+	ensure.True(t, ok, err)
+	ensure.DeepEqual(t, pushErr.Message, "BadJwtToken")
+	ensure.DeepEqual(t, string(pushErr.Body), `{"reason":"BadJwtToken"}`)
+}
+
+func TestSendAcceptedCorruptGzipBody(t *testing.T) {
+	client := &Client{
+		Client: &http.Client{
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusCreated,
+					Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+					Body:       io.NopCloser(strings.NewReader("not gzip")),
+				}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("test"), &validSubscription))
+	ensure.Nil(t, client.SendAndForget(ctx, []byte("test"), &validSubscription))
+}
+
+func TestReadBodyGzipBounded(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(bytes.Repeat([]byte("a"), 10*maxResponseBody))
+	ensure.Nil(t, err)
+	ensure.Nil(t, gz.Close())
+	body, err := readBody(&http.Response{
+		Header: http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:   io.NopCloser(&compressed),
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(body), maxResponseBody)
+}
+
+func TestReadBodyGzipEmpty(t *testing.T) {
+	body, err := readBody(&http.Response{
+		Header: http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:   http.NoBody,
+	})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(body), 0)
+}
+
+func TestSendErrorRedirect(t *testing.T) {
+	const location = "https://eu.the.push.server/capability-url"
+	client := &Client{
+		Client: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusPermanentRedirect,
+					Header:     http.Header{"Location": []string{location}},
+				}, nil
+			}),
+		},
+		VAPIDKey:   validVapidKey,
+		Subscriber: validHTTPSSubscriber,
+		TTL:        time.Hour,
+	}
+	err := client.Send(context.Background(), []byte("test"), &validSubscription)
+	ensure.True(t, errors.Is(err, ErrRedirect), err)
+	pushErr, ok := errors.AsType[*Error](err)
+	ensure.True(t, ok, err)
+	ensure.DeepEqual(t, pushErr.Location, location)
+	ensure.False(t, pushErr.Permanent)
+	ensure.StringContains(t, pushErr.Message, location)
+}
+
+func TestErrorIsVAPIDRejected(t *testing.T) {
+	cases := []struct {
+		status   int
+		rejected bool
+	}{
+		{http.StatusUnauthorized, true},
+		{http.StatusForbidden, true},
+		{http.StatusGone, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusBadRequest, false},
+	}
+	for _, c := range cases {
+		t.Run(strconv.Itoa(c.status), func(t *testing.T) {
+			err := newError(validSubscription.Endpoint, &http.Response{StatusCode: c.status}, nil)
+			ensure.DeepEqual(t, errors.Is(err, ErrVAPIDRejected), c.rejected)
+			ensure.False(t, errors.Is(err, ErrRedirect))
+		})
+	}
+}
+
+func TestErrorIsRateLimited(t *testing.T) {
+	err := newError(validSubscription.Endpoint, &http.Response{StatusCode: http.StatusTooManyRequests}, nil)
+	ensure.True(t, errors.Is(err, ErrRateLimited))
+	ensure.False(t, errors.Is(err, ErrVAPIDRejected))
+	err = newError(validSubscription.Endpoint, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil)
+	ensure.False(t, errors.Is(err, ErrRateLimited))
+}
+
+func TestErrorIsBadRequest(t *testing.T) {
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	textHeader := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	cases := []struct {
+		label  string
+		header http.Header
+		body   string
+		target error
+	}{
+		{"mozilla vapid", jsonHeader, `{"code":400,"errno":109,"error":"Bad Request","message":"Invalid VAPID public key"}`, ErrBadVAPID},
+		{"mozilla encoding", jsonHeader, `{"code":400,"errno":110,"error":"Bad Request","message":"Unknown Content-Encoding"}`, ErrBadPayload},
+		{"google authorization", textHeader, "the key in the authorization header does not correspond to the sender ID used to subscribe this user.\n", ErrBadVAPID},
+		{"google crypto", textHeader, "Failed to decrypt the message: invalid salt\n", ErrBadPayload},
+		{"google argument", jsonHeader, `{"error":{"code":400,"message":"Request contains an invalid argument.","status":"INVALID_ARGUMENT"}}`, ErrBadRequestOther},
+		{"apple jwt", jsonHeader, `{"reason":"BadJwtToken"}`, ErrBadVAPID},
+		{"apple payload", jsonHeader, `{"reason":"PayloadEmpty"}`, ErrBadPayload},
+		{"apple device", jsonHeader, `{"reason":"BadDeviceToken"}`, ErrBadRequestOther},
+		{"html", http.Header{"Content-Type": {"text/html"}}, "<html><body>Bad Request</body></html>", ErrBadRequestOther},
+		{"empty", http.Header{}, "", ErrBadRequestOther},
+	}
+	targets := []error{ErrBadVAPID, ErrBadPayload, ErrBadRequestOther}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			res := &http.Response{StatusCode: http.StatusBadRequest, Header: c.header}
+			err := newError(validSubscription.Endpoint, res, []byte(c.body))
+			for _, target := range targets {
+				ensure.DeepEqual(t, errors.Is(err, target), target == c.target, target)
+			}
+			ensure.False(t, err.Permanent)
+		})
+	}
+
+	res := &http.Response{StatusCode: http.StatusForbidden, Header: jsonHeader}
+	err := newError(validSubscription.Endpoint, res, []byte(`{"reason":"BadJwtToken"}`))
+	for _, target := range targets {
+		ensure.False(t, errors.Is(err, target))
+	}
 }
 
 func TestRealEndpoints(t *testing.T) {
@@ -0,0 +1,150 @@
+// Package webpushtest provides utilities for testing code that sends Push
+// Notifications using the webpush package.
+package webpushtest
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/daaku/webpush"
+)
+
+// Request is a recorded push request.
+type Request struct {
+	Method   string      // The HTTP method.
+	Endpoint string      // The URL the request was sent to.
+	Header   http.Header // The request headers.
+	Payload  []byte      // The decrypted message.
+}
+
+// Recorder is a http.RoundTripper that records push requests along with
+// their decrypted payloads. It is safe for concurrent use.
+type Recorder struct {
+	PrivateKey *ecdh.PrivateKey // Required User Agent private key used to decrypt payloads.
+	AuthSecret []byte           // Required auth secret used to decrypt payloads.
+
+	// Respond optionally returns the response for a request, defaults to a
+	// 201 Created response.
+	Respond func(*http.Request) *http.Response
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+// NewRecorder returns a Recorder with a new User Agent key and auth secret.
+func NewRecorder() (*Recorder, error) {
+	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	authSecret := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, authSecret); err != nil {
+		return nil, err
+	}
+	return &Recorder{PrivateKey: privateKey, AuthSecret: authSecret}, nil
+}
+
+// Subscription returns a Subscription for the endpoint using the Recorder keys.
+func (r *Recorder) Subscription(endpoint string) *webpush.Subscription {
+	return &webpush.Subscription{
+		Endpoint: endpoint,
+		Keys: webpush.Keys{
+			P256dh: base64.RawURLEncoding.EncodeToString(r.PrivateKey.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(r.AuthSecret),
+		},
+	}
+}
+
+// Client returns a http.Client using the Recorder as the Transport.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// RoundTrip records and decrypts the request.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var record []byte
+	if req.Body != nil {
+		var err error
+		record, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	payload, err := webpush.Decrypt(record, r.PrivateKey, r.AuthSecret)
+	if err != nil {
+		return nil, fmt.Errorf("webpushtest: %w", err)
+	}
+
+	r.mu.Lock()
+	r.requests = append(r.requests, Request{
+		Method:   req.Method,
+		Endpoint: req.URL.String(),
+		Header:   req.Header.Clone(),
+		Payload:  payload,
+	})
+	r.mu.Unlock()
+
+	req.Body = io.NopCloser(bytes.NewReader(record))
+	if r.Respond != nil {
+		return r.Respond(req), nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusCreated,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
+
+// Requests returns the requests recorded so far.
+func (r *Recorder) Requests() []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Request(nil), r.requests...)
+}
+
+// RequestExpectation describes the expected aspects of a Request. Empty
+// fields are not checked.
+type RequestExpectation struct {
+	Method   string
+	Endpoint string
+
+	// Header contains the headers to check, other headers in the Request are
+	// ignored. Keys are canonicalized and multiple values are compared as if
+	// they were joined with ", ", so the exact form of the header is not
+	// significant.
+	Header http.Header
+
+	Payload []byte
+}
+
+// AssertRequest reports an error on t for each aspect of r that does not match
+// the expectation.
+func AssertRequest(t testing.TB, r Request, expected RequestExpectation) {
+	t.Helper()
+	if expected.Method != "" && r.Method != expected.Method {
+		t.Errorf("webpushtest: method is %q, expected %q", r.Method, expected.Method)
+	}
+	if expected.Endpoint != "" && r.Endpoint != expected.Endpoint {
+		t.Errorf("webpushtest: endpoint is %q, expected %q", r.Endpoint, expected.Endpoint)
+	}
+	for key, values := range expected.Header {
+		want := strings.Join(values, ", ")
+		got := strings.Join(r.Header.Values(key), ", ")
+		if got != want {
+			t.Errorf("webpushtest: header %s is %q, expected %q", http.CanonicalHeaderKey(key), got, want)
+		}
+	}
+	if expected.Payload != nil && !bytes.Equal(r.Payload, expected.Payload) {
+		t.Errorf("webpushtest: payload is %q, expected %q", r.Payload, expected.Payload)
+	}
+}
@@ -0,0 +1,102 @@
+package webpushtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+	"github.com/daaku/webpush"
+)
+
+func TestRecorder(t *testing.T) {
+	rec, err := NewRecorder()
+	ensure.Nil(t, err)
+	vapidKey, err := webpush.ParseVAPIDKey("Npnu7ulDI0A5nvDXgrEreznX809sYVuIqEh7AXG2oOk")
+	ensure.Nil(t, err)
+	client := &webpush.Client{
+		Client:     rec.Client(),
+		VAPIDKey:   vapidKey,
+		Subscriber: "mailto:admin@app.server",
+		TTL:        time.Hour,
+		Topic:      "a-topic",
+	}
+	const endpoint = "https://the.push.server/capability-url"
+	ctx := context.Background()
+	ensure.Nil(t, client.Send(ctx, []byte("first"), rec.Subscription(endpoint)))
+	ensure.Nil(t, client.Send(ctx, []byte("second"), rec.Subscription(endpoint)))
+
+	requests := rec.Requests()
+	ensure.DeepEqual(t, len(requests), 2)
+	ensure.DeepEqual(t, requests[0].Endpoint, endpoint)
+	ensure.DeepEqual(t, string(requests[0].Payload), "first")
+	ensure.DeepEqual(t, string(requests[1].Payload), "second")
+	ensure.DeepEqual(t, requests[1].Header.Get("Topic"), "a-topic")
+}
+
+func TestRecorderRespond(t *testing.T) {
+	rec, err := NewRecorder()
+	ensure.Nil(t, err)
+	rec.Respond = func(*http.Request) *http.Response {
+		return &http.Response{StatusCode: http.StatusGone, Body: http.NoBody}
+	}
+	vapidKey, err := webpush.ParseVAPIDKey("Npnu7ulDI0A5nvDXgrEreznX809sYVuIqEh7AXG2oOk")
+	ensure.Nil(t, err)
+	client := &webpush.Client{
+		Client:     rec.Client(),
+		VAPIDKey:   vapidKey,
+		Subscriber: "mailto:admin@app.server",
+		TTL:        time.Hour,
+	}
+	err = client.Send(context.Background(), []byte("gone"), rec.Subscription("https://the.push.server/x"))
+	pushErr, ok := errors.AsType[*webpush.Error](err)
+	ensure.True(t, ok, err)
+	ensure.True(t, pushErr.Permanent)
+	ensure.DeepEqual(t, len(rec.Requests()), 1)
+}
+
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertRequest(t *testing.T) {
+	r := Request{
+		Method:   http.MethodPost,
+		Endpoint: "https://the.push.server/x",
+		Header: http.Header{
+			"Content-Encoding": {"aes128gcm"},
+			"Ttl":              {"60"},
+			"Via":              {"1.1 proxy-a", "1.1 proxy-b"},
+			"X-Proxy":          {"added"},
+		},
+		Payload: []byte("hello"),
+	}
+	expected := RequestExpectation{
+		Method:   http.MethodPost,
+		Endpoint: "https://the.push.server/x",
+		Header: http.Header{
+			"via":              {"1.1 proxy-a, 1.1 proxy-b"},
+			"TTL":              {"60"},
+			"content-encoding": {"aes128gcm"},
+		},
+		Payload: []byte("hello"),
+	}
+	rt := &recordingT{TB: t}
+	AssertRequest(rt, r, expected)
+	ensure.DeepEqual(t, rt.errors, []string(nil))
+
+	expected.Header.Set("Urgency", "high")
+	expected.Payload = []byte("goodbye")
+	AssertRequest(rt, r, expected)
+	ensure.DeepEqual(t, len(rt.errors), 2)
+}